@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/getlantern/systray"
+)
+
+const alertHistoryBucket = "alertHistory"
+const alertHistoryDays = 90
+const alertHistoryMenuItems = 20
+
+// What became of an alert: shown, then possibly acknowledged or snoozed from
+// the notification, or silenced because alerts were already snoozed.
+const (
+	alertShown        = "shown"
+	alertAcknowledged = "acknowledged"
+	alertSnoozed      = "snoozed"
+	alertSilenced     = "silenced"
+)
+
+type alertRecord struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	Value     float64   `json:"value"`
+	Direction string    `json:"direction"`
+	Status    string    `json:"status"`
+}
+
+// recordAlert stores an alert in the profile's alert history, returning its
+// key so the status can be updated later.
+func (p *profile) recordAlert(db *bolt.DB, a alert, status string) ([]byte, error) {
+	now := time.Now()
+	data, err := json.Marshal(alertRecord{
+		Time:      now,
+		Type:      a.Type,
+		Message:   a.Message,
+		Value:     round(p.bg.Value.Value, 1),
+		Direction: p.bg.Direction.Value,
+		Status:    status,
+	})
+	if err != nil {
+		return nil, err
+	}
+	key := historyKey(now.UnixNano())
+	return key, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(p.bucket(alertHistoryBucket))
+		if err != nil {
+			return err
+		}
+		// Alerts are kept for a while, long enough to cover the time between
+		// clinic appointments.
+		c := b.Cursor()
+		oldest := historyKey(now.AddDate(0, 0, -alertHistoryDays).UnixNano())
+		for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return b.Put(key, data)
+	})
+}
+
+// setAlertStatus records what the user did with an alert.
+func (p *profile) setAlertStatus(db *bolt.DB, key []byte, status string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket(alertHistoryBucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+		var r alertRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		r.Status = status
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// loadAlertHistory returns the alerts since from, oldest first.
+func loadAlertHistory(db *bolt.DB, bucket []byte, from time.Time) (records []alertRecord, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(historyKey(from.UnixNano())); k != nil; k, v = c.Next() {
+			var r alertRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return
+}
+
+// lastAlerts returns up to n of the most recent alerts, newest first.
+func lastAlerts(db *bolt.DB, bucket []byte, n int) (records []alertRecord, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(records) < n; k, v = c.Prev() {
+			var r alertRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return
+}
+
+func (r alertRecord) title() string {
+	when := formatClock(r.Time)
+	if y, m, d := r.Time.Date(); !(time.Now().Year() == y && time.Now().Month() == m && time.Now().Day() == d) {
+		when = r.Time.Format("Jan 2") + " " + when
+	}
+	title := when + "  " + r.Message
+	if r.Status != alertShown {
+		title += " (" + tr(r.Status) + ")"
+	}
+	return title
+}
+
+// addAlertHistoryMenu adds the alert history submenu. systray can't remove
+// items, so a fixed number are created up front and hidden until used.
+func (p *profile) addAlertHistoryMenu(db *bolt.DB) {
+	parent := p.addMenuItem(tr("Alert history"))
+	p.menu.alertHistory = make([]*systray.MenuItem, alertHistoryMenuItems)
+	for i := range p.menu.alertHistory {
+		p.menu.alertHistory[i] = parent.AddSubMenuItem("", "")
+		p.menu.alertHistory[i].Disable()
+		p.menu.alertHistory[i].Hide()
+	}
+	p.menu.noAlerts = parent.AddSubMenuItem(tr("No alerts yet"), "")
+	p.menu.noAlerts.Disable()
+	export := parent.AddSubMenuItem(tr("Export…"), "")
+	p.updateAlertHistoryMenu(db)
+	go func() {
+		for range export.ClickedCh {
+			filename, err := exportAlertHistory(db, p, alertHistoryDays, "")
+			if err != nil {
+				logError("Failed to export alert history", "profile", p.logName(), "err", err)
+				continue
+			}
+			exec.Command("xdg-open", filename).Start()
+		}
+	}()
+}
+
+func (p *profile) updateAlertHistoryMenu(db *bolt.DB) {
+	if p.menu.alertHistory == nil {
+		return
+	}
+	records, err := lastAlerts(db, p.bucket(alertHistoryBucket), alertHistoryMenuItems)
+	if err != nil {
+		logError("Failed to load alert history", "profile", p.logName(), "err", err)
+		return
+	}
+	for i, item := range p.menu.alertHistory {
+		if i < len(records) {
+			item.SetTitle(records[i].title())
+			item.Show()
+		} else {
+			item.Hide()
+		}
+	}
+	if len(records) > 0 {
+		p.menu.noAlerts.Hide()
+	} else {
+		p.menu.noAlerts.Show()
+	}
+}
+
+// exportAlertHistory writes the alerts of the last days to a CSV file that
+// opens in any spreadsheet, returning the filename.
+func exportAlertHistory(db *bolt.DB, p *profile, days int, filename string) (string, error) {
+	now := time.Now()
+	records, err := loadAlertHistory(db, p.bucket(alertHistoryBucket), now.AddDate(0, 0, -days))
+	if err != nil {
+		return "", err
+	}
+	if filename == "" && p.Name == "" {
+		filename = fmt.Sprintf("cgm-alerts-%s.csv", now.Format("2006-01-02"))
+	} else if filename == "" {
+		filename = fmt.Sprintf("cgm-alerts-%s-%s.csv", p.Name, now.Format("2006-01-02"))
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"time", "type", "message", "mmol", "mgdl", "direction", "status"})
+	for _, r := range records {
+		w.Write([]string{
+			r.Time.Format(time.RFC3339),
+			r.Type,
+			r.Message,
+			strconv.FormatFloat(r.Value, 'f', 1, 64),
+			strconv.Itoa(int(math.Round(r.Value * mgdltommol))),
+			r.Direction,
+			r.Status,
+		})
+	}
+	w.Flush()
+	return filename, w.Error()
+}
+
+func runAlertExport(db *bolt.DB, arguments []string) {
+	logToStderr()
+	alertFlags := flag.NewFlagSet("alerts", flag.ExitOnError)
+	days := alertFlags.Int("days", alertHistoryDays, "Number of days of alerts to export")
+	out := alertFlags.String("out", "", "CSV filename (default cgm-alerts-<date>.csv)")
+	name := alertFlags.String("profile", "", "Name of the profile to export (default the first profile)")
+	alertFlags.Parse(arguments)
+
+	p := profiles[0]
+	if *name != "" {
+		p = findProfile(*name)
+		if p == nil {
+			logFatal(fmt.Sprintf("No profile named %q", *name))
+		}
+	}
+	filename, err := exportAlertHistory(db, p, *days, *out)
+	if err != nil {
+		logFatal("Failed to export alert history", "err", err)
+	}
+	fmt.Println(filename)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var barColours = map[string]string{
+	"green":  "#43a047",
+	"orange": "#ef6c00",
+	"red":    "#e53935",
+}
+
+type waybarOutput struct {
+	Text       string   `json:"text"`
+	Tooltip    string   `json:"tooltip"`
+	Class      []string `json:"class"`
+	Percentage int      `json:"percentage"`
+}
+
+type i3blocksOutput struct {
+	FullText  string `json:"full_text"`
+	ShortText string `json:"short_text"`
+	Color     string `json:"color"`
+}
+
+// runBar prints the readings to stdout for status bars instead of running the
+// tray, using the same fetching and polling.
+func runBar(arguments []string) {
+	barFlags := flag.NewFlagSet("bar", flag.ExitOnError)
+	format := barFlags.String("format", "waybar", "Output format: waybar, i3blocks or polybar")
+	alerts := barFlags.Bool("alerts", false, "Send alerts, for when the tray isn't running")
+	barFlags.Parse(arguments)
+	sendAlerts = *alerts
+
+	var line func() string
+	switch *format {
+	case "waybar":
+		line = waybarLine
+	case "i3blocks":
+		line = i3blocksLine
+	case "polybar":
+		line = polybarLine
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q, expected waybar, i3blocks or polybar\n", *format)
+		os.Exit(2)
+	}
+
+	var last string
+	render = func() {
+		if l := line(); l != last {
+			fmt.Println(l)
+			last = l
+		}
+	}
+	restoreBar()
+	setBg(nil)
+	poll(nil, subscribe())
+}
+
+func barText() string {
+	if text := trayTitle(); text != "" {
+		return text
+	}
+	return "…"
+}
+
+// barTooltip describes each profile's reading, its age and any predictions.
+func barTooltip() string {
+	var lines []string
+	for _, p := range profiles {
+		if p.bg.Value.Timestamp == 0 {
+			continue
+		}
+		line := p.title() + ", " + tr("%s ago", formatAge(p.age()))
+		if p.lowTime.After(time.Now()) && p.lowTime.Before(time.Now().Add(predictLowSeconds*time.Second)) {
+			line += ", " + tr("low at %s", formatClock(p.lowTime))
+		}
+		if p.inRangeTime.After(time.Now()) {
+			line += ", " + tr("in range at %s", formatClock(p.inRangeTime))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func waybarLine() string {
+	o := waybarOutput{
+		Text:    barText(),
+		Tooltip: barTooltip(),
+		Class:   []string{worstIcon()},
+	}
+	for _, p := range profiles {
+		o.Class = append(o.Class, p.rangeState())
+		if p.isStale() {
+			o.Class = append(o.Class, "stale")
+		}
+	}
+	if len(profiles) > 0 {
+		percentage := profiles[0].bg.Value.Value / reportMaxValue * 100
+		o.Percentage = int(math.Round(math.Min(percentage, 100)))
+	}
+	line, err := json.Marshal(o)
+	if err != nil {
+		logError("Failed to encode waybar output", "err", err)
+	}
+	return string(line)
+}
+
+// i3blocksLine is JSON so the block needs format=json as well as
+// interval=persist.
+func i3blocksLine() string {
+	var short []string
+	for _, p := range profiles {
+		if p.bg.Value.Timestamp > 0 {
+			short = append(short, p.bg.format())
+		}
+	}
+	line, err := json.Marshal(i3blocksOutput{
+		FullText:  barText(),
+		ShortText: strings.Join(short, " "),
+		Color:     barColours[worstIcon()],
+	})
+	if err != nil {
+		logError("Failed to encode i3blocks output", "err", err)
+	}
+	return string(line)
+}
+
+func polybarLine() string {
+	return fmt.Sprintf("%%{F%s}%s%%{F-}", barColours[worstIcon()], barText())
+}
+
+// restoreBar shows the readings the tray last saved, then lets go of cgm.db
+// so the tray can start. The bar doesn't store history or alert state, which
+// is left to the tray.
+func restoreBar() {
+	db, err := bolt.Open("cgm.db", 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		logDebug("Not restoring the last readings", "err", err)
+		return
+	}
+	defer db.Close()
+	restoreStates(db)
+}
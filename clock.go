@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+)
+
+const clockCheckInterval = time.Hour
+const clockSkewWarning = 2 * time.Minute
+
+// checkClock measures how far the server's clock is from the local one, so
+// ages and predictions use the server's idea of now rather than a laptop
+// clock that has drifted or was never synced.
+func (p *profile) checkClock(s clockSource) {
+	p.clockCheckedAt = time.Now()
+	start := time.Now()
+	server, err := s.serverTime()
+	if err != nil {
+		logWarn("Failed to check the server clock", "profile", p.logName(), "err", err)
+		return
+	}
+	p.setClockOffset(start, server)
+}
+
+// setClockOffset works out the offset from the server's time in a response
+// to a request made at start.
+func (p *profile) setClockOffset(start time.Time, server time.Time) {
+	// The server read its clock somewhere during the request, so assume the
+	// middle of it.
+	local := start.Add(time.Since(start) / 2)
+	p.clockOffset = server.Sub(local).Round(time.Second)
+	logDebug("Checked the server clock", "profile", p.logName(), "offset", p.clockOffset)
+	if w := p.clockWarning(); w != "" {
+		logWarn(w, "profile", p.logName())
+	}
+}
+
+// now is the current time on the server's clock.
+func (p *profile) now() time.Time {
+	return time.Now().Add(p.clockOffset)
+}
+
+// readingTime converts a reading's timestamp to the local clock, for
+// comparing with time.Now and showing predictions.
+func (p *profile) readingTime(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*int64(time.Millisecond)).Add(-p.clockOffset)
+}
+
+// clockWarning describes any clock skew big enough to make ages and
+// predictions misleading: the local clock against the server's, or the
+// uploader's clock running ahead so readings appear to be from the future.
+func (p *profile) clockWarning() string {
+	switch {
+	case p.clockOffset > clockSkewWarning:
+		return tr("Clock is %s behind the server", formatAge(p.clockOffset))
+	case p.clockOffset < -clockSkewWarning:
+		return tr("Clock is %s ahead of the server", formatAge(-p.clockOffset))
+	case p.bg.Value.Timestamp > 0 && -p.age() > clockSkewWarning:
+		return tr("Uploader clock is %s ahead", formatAge(-p.age()))
+	}
+	return ""
+}
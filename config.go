@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type config struct {
+	Profiles  []*profile       `json:"profiles"`
+	Notifiers []notifierConfig `json:"notifiers"`
+	Mqtt      mqttConfig       `json:"mqtt"`
+}
+
+// loadConfig reads the -config file, if there is one, and sets up the
+// profiles, notifiers and MQTT settings. When the config has no profiles a
+// single unnamed profile is built from the command line flags.
+func loadConfig() error {
+	var c config
+	if *args.Config != "" {
+		data, err := ioutil.ReadFile(*args.Config)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("Failed to parse config %s: %s", *args.Config, err)
+		}
+	}
+
+	defaults := thresholds{
+		Urgenthigh: *args.Urgenthigh,
+		High:       *args.High,
+		Low:        *args.Low,
+	}
+	if len(c.Profiles) < 1 {
+		c.Profiles = []*profile{{
+			Source:   *args.Source,
+			Url:      *args.Url,
+			Token:    *args.Token,
+			Username: *args.Username,
+			Password: *args.Password,
+			Region:   *args.Region,
+			Patient:  *args.Patient,
+			Person:   *args.Person,
+		}}
+	}
+	templates := defaultTemplates()
+	templates.Title = *args.Title
+	explicit := explicitFlags()
+	names := map[string]bool{}
+	for _, p := range c.Profiles {
+		if len(c.Profiles) > 1 && (p.Name == "" || names[p.Name]) {
+			return fmt.Errorf("Each profile needs a unique name when following more than one site")
+		}
+		names[p.Name] = true
+		if p.Preset == "" {
+			p.Preset = *args.Preset
+		}
+		if err := p.applyPreset(defaults, explicit); err != nil {
+			return profileError(p, err)
+		}
+		p.Templates = p.Templates.withDefaults(templates)
+		if *args.DelayLows {
+			p.DelayCompressionLows = true
+		}
+		if p.Carbs == 0 {
+			p.Carbs = *args.Carbs
+		}
+		if err := p.setup(); err != nil {
+			return profileError(p, err)
+		}
+	}
+
+	profiles = c.Profiles
+	notifiers = nil
+	for i, n := range c.Notifiers {
+		notifier, err := n.notifier()
+		if err != nil {
+			return fmt.Errorf("Notifier %d: %s", i+1, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	mqttSettings = c.Mqtt
+
+	return nil
+}
+
+// profileError says which profile a config error is in, when there's more
+// than the unnamed one.
+func profileError(p *profile, err error) error {
+	if p.Name == "" {
+		return err
+	}
+	return fmt.Errorf("Profile %q: %s", p.Name, err)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const dbusInterface = "org.nightscout.Systray"
+const dbusName = "org.nightscout.Systray"
+const dbusPath = dbus.ObjectPath("/org/nightscout/Systray")
+
+var dbusPathElement = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// dbusService exposes the readings and tray actions on the session bus. The
+// main object carries the methods, the ReadingChanged signal for every
+// profile and the properties of the first profile; when following several
+// sites each profile also gets a child object with its own properties.
+type dbusService struct {
+	db    *bolt.DB
+	conn  *dbus.Conn
+	props map[*profile][]*prop.Properties
+}
+
+func startDbus(db *bolt.DB) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		logWarn("Failed to connect to the session bus", "err", err)
+		return
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		logWarn("Failed to claim D-Bus name", "name", dbusName, "err", err)
+		return
+	}
+
+	s := &dbusService{
+		db:    db,
+		conn:  conn,
+		props: map[*profile][]*prop.Properties{},
+	}
+	if err := s.export(dbusPath, profiles[0], true); err != nil {
+		logError("Failed to export D-Bus object", "path", dbusPath, "err", err)
+		return
+	}
+	if len(profiles) > 1 {
+		for _, p := range profiles {
+			path := dbusPath + dbus.ObjectPath("/"+dbusPathElement.ReplaceAllString(p.Name, "_"))
+			if err := s.export(path, p, false); err != nil {
+				logError("Failed to export D-Bus object", "path", path, "err", err)
+				return
+			}
+		}
+	}
+	readingHooks = append(readingHooks, s.readingChanged)
+}
+
+func (s *dbusService) export(path dbus.ObjectPath, p *profile, methods bool) error {
+	props, err := prop.Export(s.conn, path, prop.Map{
+		dbusInterface: {
+			"Name":      {Value: p.Name, Emit: prop.EmitTrue},
+			"Value":     {Value: p.bg.Value.Value, Emit: prop.EmitTrue},
+			"Direction": {Value: p.bg.Direction.Value, Emit: prop.EmitTrue},
+			"Timestamp": {Value: p.bg.Value.Timestamp, Emit: prop.EmitTrue},
+			"Range":     {Value: p.rangeState(), Emit: prop.EmitTrue},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	s.props[p] = append(s.props[p], props)
+
+	iface := introspect.Interface{
+		Name:       dbusInterface,
+		Properties: props.Introspection(dbusInterface),
+	}
+	if methods {
+		if err := s.conn.Export(s, path, dbusInterface); err != nil {
+			return err
+		}
+		iface.Methods = introspect.Methods(s)
+		iface.Signals = []introspect.Signal{{
+			Name: "ReadingChanged",
+			Args: []introspect.Arg{
+				{Name: "name", Type: "s"},
+				{Name: "value", Type: "d"},
+				{Name: "direction", Type: "s"},
+				{Name: "timestamp", Type: "x"},
+				{Name: "range", Type: "s"},
+			},
+		}}
+	}
+	node := &introspect.Node{
+		Name: string(path),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			iface,
+		},
+	}
+	return s.conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable")
+}
+
+func (s *dbusService) readingChanged(p *profile) {
+	for _, props := range s.props[p] {
+		props.SetMust(dbusInterface, "Value", p.bg.Value.Value)
+		props.SetMust(dbusInterface, "Direction", p.bg.Direction.Value)
+		props.SetMust(dbusInterface, "Timestamp", p.bg.Value.Timestamp)
+		props.SetMust(dbusInterface, "Range", p.rangeState())
+	}
+	err := s.conn.Emit(dbusPath, dbusInterface+".ReadingChanged", p.Name, p.bg.Value.Value, p.bg.Direction.Value, p.bg.Value.Timestamp, p.rangeState())
+	if err != nil {
+		logWarn("Failed to emit ReadingChanged", "profile", p.logName(), "err", err)
+	}
+}
+
+// Refresh fetches the latest readings, the same as the Refresh menu item.
+func (s *dbusService) Refresh() *dbus.Error {
+	setBg(s.db)
+	return nil
+}
+
+// Snooze silences alert notifications for the given number of minutes.
+func (s *dbusService) Snooze(minutes uint32) *dbus.Error {
+	snooze(time.Duration(minutes) * time.Minute)
+	return nil
+}
+
+// SetShowCurrent shows or hides the reading in the tray title.
+func (s *dbusService) SetShowCurrent(show bool) *dbus.Error {
+	setShowCurrent(show, s.db)
+	return nil
+}
+
+// Report generates a report of the named profile's last days, or the first
+// profile's when name is empty, and returns the file it was written to. An
+// empty filename writes to the reports directory.
+func (s *dbusService) Report(name string, days uint32, filename string) (string, *dbus.Error) {
+	p := profiles[0]
+	if name != "" {
+		if p = findProfile(name); p == nil {
+			return "", dbus.MakeFailedError(fmt.Errorf("No profile named %q", name))
+		}
+	}
+	filename, err := generateReport(s.db, p, int(days), filename)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return filename, nil
+}
+
+// remoteReport asks the running tray to generate a report, for when it has
+// the db open.
+func remoteReport(name string, days int, filename string) (string, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.Object(dbusName, dbusPath).Call(dbusInterface+".Report", 0, name, uint32(days), filename).Store(&filename)
+	return filename, err
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/beeep"
+	"github.com/godbus/dbus/v5"
+)
+
+const notificationsName = "org.freedesktop.Notifications"
+const notificationsPath = dbus.ObjectPath("/org/freedesktop/Notifications")
+const notificationIconSize = 64
+
+// notificationDismissed is the NotificationClosed reason for the user closing
+// a notification, as opposed to it expiring or being replaced.
+const notificationDismissed uint32 = 2
+
+// urgencies are the freedesktop urgency levels.
+const (
+	urgencyNormal   byte = 1
+	urgencyCritical byte = 2
+)
+
+// criticalAlerts are shown with critical urgency so they stay on screen until
+// dismissed.
+var criticalAlerts = map[string]bool{
+	"Low":           true,
+	"Predicted low": true,
+	"Urgent high":   true,
+}
+
+// notificationImage is the image-data hint, (iiibiiay) in D-Bus terms.
+type notificationImage struct {
+	Width         int32
+	Height        int32
+	RowStride     int32
+	HasAlpha      bool
+	BitsPerSample int32
+	Channels      int32
+	Data          []byte
+}
+
+// desktopNotifier shows alerts through the freedesktop notification service.
+// Each profile and alert type keeps one bubble that repeated alerts replace,
+// and the actions on it are handled here.
+type desktopNotifier struct {
+	conn   *dbus.Conn
+	mutex  sync.Mutex
+	ids    map[string]uint32
+	shown  map[uint32]*profile
+	acks   map[uint32]func(status string)
+	images map[string]notificationImage
+}
+
+var (
+	desktop     *desktopNotifier
+	desktopOnce sync.Once
+)
+
+// desktopNotifications connects to the notification service the first time
+// it's needed, returning nil if there isn't one.
+func desktopNotifications() *desktopNotifier {
+	desktopOnce.Do(func() {
+		conn, err := dbus.ConnectSessionBus()
+		if err != nil {
+			logWarn("Failed to connect to the session bus for notifications", "err", err)
+			return
+		}
+		err = conn.AddMatchSignal(
+			dbus.WithMatchObjectPath(notificationsPath),
+			dbus.WithMatchInterface(notificationsName),
+		)
+		if err != nil {
+			logWarn("Failed to watch notification signals", "err", err)
+			conn.Close()
+			return
+		}
+		desktop = &desktopNotifier{
+			conn:   conn,
+			ids:    map[string]uint32{},
+			shown:  map[uint32]*profile{},
+			acks:   map[uint32]func(status string){},
+			images: map[string]notificationImage{},
+		}
+		signals := make(chan *dbus.Signal, 10)
+		conn.Signal(signals)
+		go desktop.handleSignals(signals)
+	})
+	return desktop
+}
+
+// notify shows the alert, calling ack, if it's not nil, when the user
+// dismisses the notification or uses one of its actions.
+func (d *desktopNotifier) notify(p *profile, a alert, ack func(status string)) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := p.Name + "\x00" + a.Type
+	actions := []string{"snooze", tr("Snooze 30m")}
+	if p.Url != "" {
+		actions = append(actions, "open", tr("Open Nightscout"))
+	}
+	if _, ok := p.source.(carbSource); ok && p.Carbs > 0 {
+		actions = append(actions, "carbs", tr("Log %dg carbs", p.Carbs))
+	}
+	urgency := urgencyNormal
+	sound := "dialog-information"
+	if criticalAlerts[a.Type] {
+		urgency = urgencyCritical
+		sound = "alarm-clock-elapsed"
+	}
+	hints := map[string]dbus.Variant{
+		"urgency":       dbus.MakeVariant(urgency),
+		"category":      dbus.MakeVariant("device"),
+		"desktop-entry": dbus.MakeVariant("cgm"),
+		"sound-name":    dbus.MakeVariant(sound),
+	}
+	if img, err := d.image(p.getIcon()); err != nil {
+		logWarn("Failed to convert notification icon", "err", err)
+	} else {
+		hints["image-data"] = dbus.MakeVariant(img)
+	}
+
+	var id uint32
+	err := d.conn.Object(notificationsName, notificationsPath).Call(
+		notificationsName+".Notify", 0,
+		"CGM", d.ids[key], "", p.label(a.Message), "", actions, hints, int32(-1),
+	).Store(&id)
+	if err != nil {
+		return err
+	}
+	delete(d.shown, d.ids[key])
+	delete(d.acks, d.ids[key])
+	d.ids[key] = id
+	d.shown[id] = p
+	if ack != nil {
+		d.acks[id] = ack
+	}
+	return nil
+}
+
+// image converts one of the tray icons to image-data, scaled down since
+// notification servers show them small anyway. Converted icons are kept so
+// it's only done once.
+func (d *desktopNotifier) image(name string) (notificationImage, error) {
+	if img, ok := d.images[name]; ok {
+		return img, nil
+	}
+	data, err := decodedIcon(name)
+	if err != nil {
+		return notificationImage{}, err
+	}
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return notificationImage{}, err
+	}
+	size := notificationIconSize
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/size, bounds.Min.Y+y*bounds.Dy()/size))
+		}
+	}
+	img := notificationImage{
+		Width:         int32(size),
+		Height:        int32(size),
+		RowStride:     int32(dst.Stride),
+		HasAlpha:      true,
+		BitsPerSample: 8,
+		Channels:      4,
+		Data:          dst.Pix,
+	}
+	d.images[name] = img
+	return img, nil
+}
+
+func (d *desktopNotifier) handleSignals(signals <-chan *dbus.Signal) {
+	for s := range signals {
+		if len(s.Body) < 1 {
+			continue
+		}
+		id, ok := s.Body[0].(uint32)
+		if !ok {
+			continue
+		}
+		d.mutex.Lock()
+		p := d.shown[id]
+		ack := d.acks[id]
+		// Only the first response counts, as using an action usually closes
+		// the notification too.
+		delete(d.acks, id)
+		d.mutex.Unlock()
+		if p == nil {
+			continue
+		}
+		if ack == nil {
+			ack = func(string) {}
+		}
+		// ack updates the alert history menu, which raise also does.
+		acked := ack
+		ack = func(status string) {
+			setBgMutex.Lock()
+			defer setBgMutex.Unlock()
+			acked(status)
+		}
+
+		switch s.Name {
+		case notificationsName + ".ActionInvoked":
+			if len(s.Body) < 2 {
+				continue
+			}
+			switch s.Body[1] {
+			case "snooze":
+				snooze(30 * time.Minute)
+				ack(alertSnoozed)
+			case "open":
+				exec.Command("xdg-open", p.browserUrl()).Start()
+				ack(alertAcknowledged)
+			case "carbs":
+				go logCarbs(p, ack)
+			}
+		case notificationsName + ".NotificationClosed":
+			if len(s.Body) > 1 && s.Body[1] == notificationDismissed {
+				ack(alertAcknowledged)
+			}
+			d.mutex.Lock()
+			delete(d.shown, id)
+			for k, v := range d.ids {
+				if v == id {
+					delete(d.ids, k)
+				}
+			}
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// showNotification shows the alert on the desktop, falling back to beeep when
+// there's no notification service on the session bus. ack is told when the
+// user responds to it, which beeep can't report.
+func (p *profile) showNotification(a alert, ack func(status string)) {
+	if d := desktopNotifications(); d != nil {
+		err := d.notify(p, a, ack)
+		if err == nil {
+			return
+		}
+		logWarn("Failed to show desktop notification, falling back to beeep", "profile", p.logName(), "err", err)
+	}
+
+	var filename string
+	file, err := ioutil.TempFile("", "red.png")
+	if err == nil {
+		defer os.Remove(file.Name())
+		defer file.Close()
+		img, err := decodedIcon("red")
+		if err != nil {
+			logWarn("Failed to decode notification icon", "err", err)
+		} else {
+			file.Write(img)
+			filename = file.Name()
+		}
+	}
+	beeep.Alert("CGM", p.label(a.Message), filename)
+}
+
+// logCarbs records the profile's usual carbs from a notification action,
+// acknowledging the alert once they're logged.
+func logCarbs(p *profile, ack func(status string)) {
+	if err := p.source.(carbSource).logCarbs(p.Carbs); err != nil {
+		logError("Failed to log carbs", "profile", p.logName(), "err", err)
+		return
+	}
+	logInfo("Logged carbs", "profile", p.logName(), "grams", p.Carbs)
+	ack(alertAcknowledged)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const dexcomApplicationId = "d89443d2-327c-4a6f-89e5-496bbb0317db"
+const dexcomMaxCount = 288
+const dexcomMaxMinutes = 1440
+
+var (
+	dexcomServers = map[string]string{
+		"us":  "https://share2.dexcom.com/ShareWebServices/Services",
+		"ous": "https://shareous1.dexcom.com/ShareWebServices/Services",
+	}
+	// dexcomTrends maps Share trend codes, which older accounts report as
+	// numbers and newer ones as names, onto nightscout directions.
+	dexcomTrends = map[string]string{
+		"0":              "None",
+		"1":              "DoubleUp",
+		"2":              "SingleUp",
+		"3":              "FortyFiveUp",
+		"4":              "Flat",
+		"5":              "FortyFiveDown",
+		"6":              "SingleDown",
+		"7":              "DoubleDown",
+		"8":              "None",
+		"9":              "None",
+		"NotComputable":  "None",
+		"RateOutOfRange": "None",
+	}
+	dexcomDate = regexp.MustCompile(`Date\((\d+)`)
+)
+
+type dexcomSource struct {
+	server    string
+	username  string
+	password  string
+	sessionId string
+	mutex     sync.Mutex
+}
+
+type dexcomReading struct {
+	WT    string
+	Value int
+	Trend json.RawMessage
+}
+
+type dexcomError struct {
+	Code    string
+	Message string
+}
+
+func newDexcomSource(username string, password string, region string, server string) (*dexcomSource, error) {
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("A Dexcom Share username and password are required")
+	}
+	if server == "" {
+		if region == "" {
+			region = "us"
+		}
+		server = dexcomServers[region]
+		if server == "" {
+			return nil, fmt.Errorf("Unknown Dexcom region %q, expected us or ous", region)
+		}
+	}
+	return &dexcomSource{
+		server:   server,
+		username: username,
+		password: password,
+	}, nil
+}
+
+func (s *dexcomSource) post(path string, body interface{}, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := sourceClient.Post(s.server+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e dexcomError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("Dexcom Share request failed: %s %s %s", resp.Status, e.Code, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *dexcomSource) login() error {
+	var accountId string
+	err := s.post("/General/AuthenticatePublisherAccount", map[string]string{
+		"accountName":   s.username,
+		"password":      s.password,
+		"applicationId": dexcomApplicationId,
+	}, &accountId)
+	if err != nil {
+		return err
+	}
+	return s.post("/General/LoginPublisherAccountById", map[string]string{
+		"accountId":     accountId,
+		"password":      s.password,
+		"applicationId": dexcomApplicationId,
+	}, &s.sessionId)
+}
+
+// readings fetches glucose values, logging in first if there is no session
+// and once more if the session has expired.
+func (s *dexcomSource) readings(minutes int, maxCount int) ([]reading, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var values []dexcomReading
+	err := fmt.Errorf("No session")
+	for attempt := 0; attempt < 2 && err != nil; attempt++ {
+		if s.sessionId == "" || attempt > 0 {
+			if err = s.login(); err != nil {
+				return nil, err
+			}
+		}
+		path := fmt.Sprintf("/Publisher/ReadPublisherLatestGlucoseValues?sessionId=%s&minutes=%d&maxCount=%d", s.sessionId, minutes, maxCount)
+		err = s.post(path, nil, &values)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readings := make([]reading, 0, len(values))
+	for _, v := range values {
+		match := dexcomDate.FindStringSubmatch(v.WT)
+		if match == nil {
+			return nil, fmt.Errorf("Unexpected Dexcom timestamp %q", v.WT)
+		}
+		timestamp, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading{
+			Timestamp: timestamp,
+			Mgdl:      v.Value,
+			Direction: dexcomTrend(v.Trend),
+		})
+	}
+	return readings, nil
+}
+
+func dexcomTrend(trend json.RawMessage) string {
+	var name string
+	if err := json.Unmarshal(trend, &name); err != nil {
+		name = string(trend)
+	}
+	if direction, ok := dexcomTrends[name]; ok {
+		return direction
+	}
+	return name
+}
+
+func (s *dexcomSource) latest() (reading, error) {
+	readings, err := s.readings(dexcomMaxMinutes, 1)
+	if err != nil {
+		return reading{}, err
+	}
+	if len(readings) < 1 {
+		return reading{}, fmt.Errorf("No Dexcom readings in the last %d minutes", dexcomMaxMinutes)
+	}
+	return readings[0], nil
+}
+
+// history is limited by Share to the last day of readings.
+func (s *dexcomSource) history(since time.Time) ([]reading, error) {
+	minutes := int(time.Since(since).Minutes()) + 1
+	if minutes > dexcomMaxMinutes {
+		minutes = dexcomMaxMinutes
+	}
+	return s.readings(minutes, dexcomMaxCount)
+}
+
+func (s *dexcomSource) interval() time.Duration {
+	return 5 * time.Minute
+}
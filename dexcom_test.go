@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeShare is a stand-in for the Dexcom Share API. Sessions marked expired
+// are rejected the way Share rejects timed out ones.
+type fakeShare struct {
+	logins   int
+	expired  map[string]bool
+	readings string
+}
+
+func (f *fakeShare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/General/AuthenticatePublisherAccount":
+		if body["accountName"] != "sam" || body["password"] != "secret" || body["applicationId"] != dexcomApplicationId {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(dexcomError{"AccountPasswordInvalid", "Bad password"})
+			return
+		}
+		json.NewEncoder(w).Encode("account-1")
+	case "/General/LoginPublisherAccountById":
+		if body["accountId"] != "account-1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(dexcomError{"AccountNotFound", "No account"})
+			return
+		}
+		f.logins++
+		json.NewEncoder(w).Encode("session-" + strconv.Itoa(f.logins))
+	case "/Publisher/ReadPublisherLatestGlucoseValues":
+		session := r.URL.Query().Get("sessionId")
+		if session == "" || f.expired[session] {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(dexcomError{"SessionIdNotFound", "Session not active or timed out"})
+			return
+		}
+		w.Write([]byte(f.readings))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeShare(t *testing.T, readings string) (*fakeShare, *dexcomSource) {
+	f := &fakeShare{expired: map[string]bool{}, readings: readings}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	s, err := newDexcomSource("sam", "secret", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func TestDexcomLogin(t *testing.T) {
+	f, s := newFakeShare(t, `[{"WT":"Date(1700000000000)","Value":120,"Trend":"Flat"}]`)
+	r, err := s.latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.logins != 1 || s.sessionId != "session-1" {
+		t.Errorf("Expected one login giving session-1, got %d logins and %q", f.logins, s.sessionId)
+	}
+	if r.Timestamp != 1700000000000 || r.Mgdl != 120 || r.Direction != "Flat" {
+		t.Errorf("Unexpected reading %+v", r)
+	}
+
+	if _, err := s.latest(); err != nil {
+		t.Fatal(err)
+	}
+	if f.logins != 1 {
+		t.Errorf("Expected the session to be reused, got %d logins", f.logins)
+	}
+}
+
+func TestDexcomBadPassword(t *testing.T) {
+	_, s := newFakeShare(t, `[]`)
+	s.password = "wrong"
+	if _, err := s.latest(); err == nil {
+		t.Error("Expected an error for a bad password")
+	}
+}
+
+func TestDexcomSessionExpired(t *testing.T) {
+	f, s := newFakeShare(t, `[{"WT":"Date(1700000000000)","Value":120,"Trend":4}]`)
+	if _, err := s.latest(); err != nil {
+		t.Fatal(err)
+	}
+	f.expired[s.sessionId] = true
+	if _, err := s.latest(); err != nil {
+		t.Fatal(err)
+	}
+	if f.logins != 2 || s.sessionId != "session-2" {
+		t.Errorf("Expected a second login giving session-2, got %d logins and %q", f.logins, s.sessionId)
+	}
+}
+
+func TestDexcomTrends(t *testing.T) {
+	tests := map[string]string{
+		`1`:                "DoubleUp",
+		`4`:                "Flat",
+		`7`:                "DoubleDown",
+		`0`:                "None",
+		`"SingleUp"`:       "SingleUp",
+		`"FortyFiveDown"`:  "FortyFiveDown",
+		`"NotComputable"`:  "None",
+		`"RateOutOfRange"`: "None",
+	}
+	for trend, want := range tests {
+		if got := dexcomTrend(json.RawMessage(trend)); got != want {
+			t.Errorf("dexcomTrend(%s) = %q, want %q", trend, got, want)
+		}
+	}
+}
+
+func TestDexcomDates(t *testing.T) {
+	_, s := newFakeShare(t, `[
+		{"WT":"Date(1700000300000)","Value":121,"Trend":"Flat"},
+		{"WT":"/Date(1700000000000)/","Value":118,"Trend":"SingleUp"},
+		{"WT":"Date(1699999700000-0500)","Value":110,"Trend":3}
+	]`)
+	readings, err := s.history(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{1700000300000, 1700000000000, 1699999700000}
+	if len(readings) != len(want) {
+		t.Fatalf("Expected %d readings, got %d", len(want), len(readings))
+	}
+	for i, r := range readings {
+		if r.Timestamp != want[i] {
+			t.Errorf("Reading %d timestamp = %d, want %d", i, r.Timestamp, want[i])
+		}
+	}
+
+	_, s = newFakeShare(t, `[{"WT":"yesterday","Value":121,"Trend":"Flat"}]`)
+	if _, err := s.latest(); err == nil {
+		t.Error("Expected an error for an unparseable timestamp")
+	}
+}
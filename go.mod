@@ -3,7 +3,8 @@ module cgm
 go 1.16
 
 require (
-	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/boltdb/bolt v1.3.1
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/gen2brain/beeep v0.0.0-20220518085355-d7852edf42fc
 	github.com/getlantern/context v0.0.0-20220418194847-3d5e7a086201 // indirect
 	github.com/getlantern/golog v0.0.0-20211223150227-d4d95a44d873 // indirect
@@ -11,6 +12,8 @@ require (
 	github.com/getlantern/ops v0.0.0-20220418195917-45286e0140f6 // indirect
 	github.com/getlantern/systray v1.2.1
 	github.com/go-stack/stack v1.8.1 // indirect
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gorilla/websocket v1.5.0
 	go.opentelemetry.io/otel v1.7.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
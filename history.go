@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const historyBucket = "history"
+const historyDays = 14
+
+type historyEntry struct {
+	Timestamp int64
+	Value     float64
+	Direction string
+}
+
+type nightscoutEntry struct {
+	Date      int64  `json:"date"`
+	Sgv       int    `json:"sgv"`
+	Direction string `json:"direction"`
+	Noise     int    `json:"noise"`
+}
+
+func (h historyEntry) time() time.Time {
+	return time.Unix(0, h.Timestamp*int64(time.Millisecond))
+}
+
+func historyKey(timestamp int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(timestamp))
+	return k
+}
+
+func saveHistory(db *bolt.DB, bucket []byte, entries ...historyEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(e.Timestamp), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func loadHistory(db *bolt.DB, bucket []byte, from time.Time, to time.Time) (entries []historyEntry, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		max := historyKey(to.UnixNano() / int64(time.Millisecond))
+		c := b.Cursor()
+		for k, v := c.Seek(historyKey(from.UnixNano() / int64(time.Millisecond))); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			var e historyEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return
+}
+
+func lastHistoryTimestamp(db *bolt.DB, bucket []byte) (timestamp int64) {
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		k, _ := b.Cursor().Last()
+		if k != nil {
+			timestamp = int64(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return
+}
+
+// backfillHistory fetches any entries from the last historyDays days that
+// are missing from the local history, so reports cover time the tray was not
+// running.
+func (p *profile) backfillHistory(db *bolt.DB) error {
+	since := time.Now().AddDate(0, 0, -historyDays)
+	if last := lastHistoryTimestamp(db, p.bucket(historyBucket)); last > since.UnixNano()/int64(time.Millisecond) {
+		since = time.Unix(0, last*int64(time.Millisecond))
+	}
+	readings, err := p.source.history(since)
+	if err != nil {
+		return err
+	}
+	entries := make([]historyEntry, 0, len(readings))
+	for _, r := range readings {
+		d, ok := directions[r.Direction]
+		if !ok {
+			d = directions[fallbackDirection]
+		}
+		entries = append(entries, historyEntry{
+			Timestamp: r.Timestamp,
+			Value:     float64(r.Mgdl) / mgdltommol,
+			Direction: d.Value,
+		})
+	}
+	return saveHistory(db, p.bucket(historyBucket), entries...)
+}
+
+// loadRecent fills in the readings before a new one from the history, so
+// the delta, predictions, rate alerts and suspect reading checks work from
+// the first fetch after a restart. It runs before the new reading is set, and
+// when no state was restored makes the last stored reading the current one,
+// so the new reading gets a previous one.
+func (p *profile) loadRecent(db *bolt.DB, before int64) error {
+	until := time.Unix(0, before*int64(time.Millisecond))
+	entries, err := loadHistory(db, p.bucket(historyBucket), until.Add(-recentWindow), until.Add(-time.Millisecond))
+	if err != nil || len(entries) < 1 {
+		return err
+	}
+	p.recent = nil
+	for _, e := range entries {
+		p.recent = append(p.recent, bgValue{
+			Timestamp: e.Timestamp,
+			Value:     e.Value,
+		})
+	}
+	if p.bg.Value.Timestamp > 0 {
+		return nil
+	}
+	e := entries[len(entries)-1]
+	p.bg.Value = bgValue{
+		Timestamp: e.Timestamp,
+		Value:     e.Value,
+	}
+	for _, d := range directions {
+		if d.Value == e.Direction {
+			p.bg.Direction = d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// locale is the language and region of a POSIX locale such as de_DE.UTF-8.
+type locale struct {
+	language string
+	region   string
+}
+
+// catalogue maps English messages to their translation. Messages with verbs
+// are fmt formats and the translations take the same arguments.
+type catalogue map[string]string
+
+// twelveHourRegions are the regions where times are normally shown on a 12
+// hour clock.
+var twelveHourRegions = map[string]bool{
+	"US": true,
+	"CA": true,
+	"AU": true,
+	"NZ": true,
+	"IN": true,
+	"PH": true,
+}
+
+var (
+	messages    = catalogues[localeFromEnv("LC_MESSAGES").language]
+	clockLayout = localeFromEnv("LC_TIME").clockLayout()
+)
+
+// localeFromEnv finds the locale for a category the same way as setlocale,
+// with LC_ALL overriding the category and LANG as the fallback.
+func localeFromEnv(category string) locale {
+	for _, name := range []string{"LC_ALL", category, "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return parseLocale(v)
+		}
+	}
+	return locale{language: "en"}
+}
+
+func parseLocale(s string) locale {
+	if i := strings.IndexAny(s, ".@"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.SplitN(s, "_", 2)
+	l := locale{language: strings.ToLower(parts[0])}
+	if len(parts) > 1 {
+		l.region = strings.ToUpper(parts[1])
+	}
+	if l.language == "" || l.language == "c" || l.language == "posix" {
+		l.language = "en"
+	}
+	return l
+}
+
+func (l locale) clockLayout() string {
+	if twelveHourRegions[l.region] && (l.language == "en" || l.region == "US") {
+		return "3:04 PM"
+	}
+	return "15:04"
+}
+
+// tr translates the message, formatting it with any arguments. Messages
+// without a translation are shown in English.
+func tr(message string, a ...interface{}) string {
+	if t, ok := messages[message]; ok {
+		message = t
+	}
+	if len(a) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, a...)
+}
+
+// formatClock shows a time of day in the locale's layout.
+func formatClock(t time.Time) string {
+	return t.Format(clockLayout)
+}
+
+var catalogues = map[string]catalogue{
+	"de": {
+		"Refresh":                          "Aktualisieren",
+		"Snooze alerts for 30 minutes":     "Alarme für 30 Minuten stummschalten",
+		"Show current value":               "Aktuellen Wert anzeigen",
+		"Quit":                             "Beenden",
+		"Open in browser":                  "Im Browser öffnen",
+		"Generate report":                  "Bericht erstellen",
+		"Alerts":                           "Alarme",
+		"Predicted low":                    "Niedrig vorhergesagt",
+		"Low":                              "Niedrig",
+		"Falling fast":                     "Schnell fallend",
+		"Urgent high":                      "Dringend hoch",
+		"Rising fast":                      "Schnell steigend",
+		"Failed to get BG direction. %.1f": "BZ-Richtung konnte nicht ermittelt werden. %.1f",
+		"Rising fast! %.1f %s":             "Schnell steigend! %.1f %s",
+		"Falling fast! %.1f %s":            "Schnell fallend! %.1f %s",
+		"Low! %.1f %s":                     "Niedrig! %.1f %s",
+		"Urgent high! %.1f %s":             "Dringend hoch! %.1f %s",
+		"Predicted low at %s!":             "Niedrig vorhergesagt um %s!",
+		"Previous bg":                      "Vorheriger BZ",
+		"Low at":                           "Niedrig um",
+		"In range at":                      "Im Zielbereich um",
+		"Rate":                             "Änderung",
+		"low at %s":                        "niedrig um %s",
+		"in range at %s":                   "im Zielbereich um %s",
+		"%s ago":                           "vor %s",
+		"%d min":                           "%d Min.",
+		"%dh %dm":                          "%d Std. %d Min.",
+		"Clock is %s behind the server":    "Die Uhr geht gegenüber dem Server %s nach",
+		"Clock is %s ahead of the server":  "Die Uhr geht gegenüber dem Server %s vor",
+		"Uploader clock is %s ahead":       "Die Uhr des Uploaders geht %s vor",
+		"(cached, %s old)":                 "(zwischengespeichert, %s alt)",
+		"Snooze 30m":                       "30 Min. stumm",
+		"Open Nightscout":                  "Nightscout öffnen",
+		"Possible compression low":         "Mögliches Kompressionstief",
+		"Sensor noise":                     "Sensorrauschen",
+		"Stale data":                       "Veraltete Daten",
+		"Loop failure":                     "Loop-Ausfall",
+		"No readings for %s":               "Seit %s keine Werte",
+		"Loop hasn't run for %s":           "Loop läuft seit %s nicht",
+		"Last treatment %s ago":            "Letzte Behandlung vor %s",
+		"Alert history":                    "Alarmverlauf",
+		"No alerts yet":                    "Noch keine Alarme",
+		"Export…":                          "Exportieren…",
+		"acknowledged":                     "bestätigt",
+		"snoozed":                          "stummgeschaltet",
+		"silenced":                         "unterdrückt",
+		"Server":                           "Server",
+		"Use server thresholds":            "Server-Grenzwerte verwenden",
+		"API unreachable: %s":              "API nicht erreichbar: %s",
+		"API reachable, %d ms":             "API erreichbar, %d ms",
+		"Last upload %s (%s ago)":          "Letzter Upload %s (vor %s)",
+		"Uploader battery %d%%":            "Uploader-Akku %d%%",
+		"Nightscout %s":                    "Nightscout %s",
+		"Plugins: %s":                      "Plugins: %s",
+		"Units: %s":                        "Einheiten: %s",
+		"Target range %.1f–%.1f":           "Zielbereich %.1f–%.1f",
+		"Alarms below %.1f and above %.1f": "Alarme unter %.1f und über %.1f",
+		"Compression low at %s":            "Kompressionstief um %s",
+		"Log %dg carbs":                    "%dg Kohlenhydrate eintragen",
+	},
+	"es": {
+		"Refresh":                          "Actualizar",
+		"Snooze alerts for 30 minutes":     "Silenciar alertas durante 30 minutos",
+		"Show current value":               "Mostrar valor actual",
+		"Quit":                             "Salir",
+		"Open in browser":                  "Abrir en el navegador",
+		"Generate report":                  "Generar informe",
+		"Alerts":                           "Alertas",
+		"Predicted low":                    "Bajo previsto",
+		"Low":                              "Bajo",
+		"Falling fast":                     "Bajando rápido",
+		"Urgent high":                      "Alto urgente",
+		"Rising fast":                      "Subiendo rápido",
+		"Failed to get BG direction. %.1f": "No se pudo obtener la tendencia de la glucosa. %.1f",
+		"Rising fast! %.1f %s":             "¡Subiendo rápido! %.1f %s",
+		"Falling fast! %.1f %s":            "¡Bajando rápido! %.1f %s",
+		"Low! %.1f %s":                     "¡Bajo! %.1f %s",
+		"Urgent high! %.1f %s":             "¡Alto urgente! %.1f %s",
+		"Predicted low at %s!":             "¡Bajo previsto a las %s!",
+		"Previous bg":                      "Glucosa anterior",
+		"Low at":                           "Bajo a las",
+		"In range at":                      "En rango a las",
+		"Rate":                             "Variación",
+		"low at %s":                        "bajo a las %s",
+		"in range at %s":                   "en rango a las %s",
+		"%s ago":                           "hace %s",
+		"%dh %dm":                          "%d h %d min",
+		"Clock is %s behind the server":    "El reloj va %s por detrás del servidor",
+		"Clock is %s ahead of the server":  "El reloj va %s por delante del servidor",
+		"Uploader clock is %s ahead":       "El reloj del uploader va %s adelantado",
+		"(cached, %s old)":                 "(en caché, hace %s)",
+		"Snooze 30m":                       "Silenciar 30 min",
+		"Open Nightscout":                  "Abrir Nightscout",
+		"Possible compression low":         "Posible bajo por compresión",
+		"Sensor noise":                     "Ruido del sensor",
+		"Stale data":                       "Datos antiguos",
+		"Loop failure":                     "Fallo del loop",
+		"No readings for %s":               "Sin lecturas desde hace %s",
+		"Loop hasn't run for %s":           "El loop no se ejecuta desde hace %s",
+		"Last treatment %s ago":            "Último tratamiento hace %s",
+		"Alert history":                    "Historial de alertas",
+		"No alerts yet":                    "Aún no hay alertas",
+		"Export…":                          "Exportar…",
+		"acknowledged":                     "confirmada",
+		"snoozed":                          "pospuesta",
+		"silenced":                         "silenciada",
+		"Server":                           "Servidor",
+		"Use server thresholds":            "Usar los umbrales del servidor",
+		"API unreachable: %s":              "API inaccesible: %s",
+		"API reachable, %d ms":             "API accesible, %d ms",
+		"Last upload %s (%s ago)":          "Última subida %s (hace %s)",
+		"Uploader battery %d%%":            "Batería del uploader %d%%",
+		"Nightscout %s":                    "Nightscout %s",
+		"Plugins: %s":                      "Plugins: %s",
+		"Units: %s":                        "Unidades: %s",
+		"Target range %.1f–%.1f":           "Rango objetivo %.1f–%.1f",
+		"Alarms below %.1f and above %.1f": "Alarmas por debajo de %.1f y por encima de %.1f",
+		"Compression low at %s":            "Bajo por compresión a las %s",
+		"Log %dg carbs":                    "Registrar %dg de carbohidratos",
+	},
+	"fr": {
+		"Refresh":                          "Actualiser",
+		"Snooze alerts for 30 minutes":     "Suspendre les alertes pendant 30 minutes",
+		"Show current value":               "Afficher la valeur actuelle",
+		"Quit":                             "Quitter",
+		"Open in browser":                  "Ouvrir dans le navigateur",
+		"Generate report":                  "Générer un rapport",
+		"Alerts":                           "Alertes",
+		"Predicted low":                    "Bas prévu",
+		"Low":                              "Bas",
+		"Falling fast":                     "Baisse rapide",
+		"Urgent high":                      "Haut urgent",
+		"Rising fast":                      "Hausse rapide",
+		"Failed to get BG direction. %.1f": "Impossible d'obtenir la tendance de la glycémie. %.1f",
+		"Rising fast! %.1f %s":             "Hausse rapide ! %.1f %s",
+		"Falling fast! %.1f %s":            "Baisse rapide ! %.1f %s",
+		"Low! %.1f %s":                     "Bas ! %.1f %s",
+		"Urgent high! %.1f %s":             "Haut urgent ! %.1f %s",
+		"Predicted low at %s!":             "Bas prévu à %s !",
+		"Previous bg":                      "Glycémie précédente",
+		"Low at":                           "Bas à",
+		"In range at":                      "Dans la cible à",
+		"Rate":                             "Variation",
+		"low at %s":                        "bas à %s",
+		"in range at %s":                   "dans la cible à %s",
+		"%s ago":                           "il y a %s",
+		"%dh %dm":                          "%d h %d min",
+		"Clock is %s behind the server":    "L'horloge retarde de %s sur le serveur",
+		"Clock is %s ahead of the server":  "L'horloge avance de %s sur le serveur",
+		"Uploader clock is %s ahead":       "L'horloge de l'uploader avance de %s",
+		"(cached, %s old)":                 "(en cache, il y a %s)",
+		"Snooze 30m":                       "Suspendre 30 min",
+		"Open Nightscout":                  "Ouvrir Nightscout",
+		"Possible compression low":         "Possible hypo de compression",
+		"Sensor noise":                     "Bruit du capteur",
+		"Stale data":                       "Données périmées",
+		"Loop failure":                     "Échec de la boucle",
+		"No readings for %s":               "Aucune valeur depuis %s",
+		"Loop hasn't run for %s":           "La boucle ne tourne plus depuis %s",
+		"Last treatment %s ago":            "Dernier traitement il y a %s",
+		"Alert history":                    "Historique des alertes",
+		"No alerts yet":                    "Aucune alerte pour l'instant",
+		"Export…":                          "Exporter…",
+		"acknowledged":                     "acquittée",
+		"snoozed":                          "reportée",
+		"silenced":                         "silencieuse",
+		"Server":                           "Serveur",
+		"Use server thresholds":            "Utiliser les seuils du serveur",
+		"API unreachable: %s":              "API injoignable : %s",
+		"API reachable, %d ms":             "API joignable, %d ms",
+		"Last upload %s (%s ago)":          "Dernier envoi %s (il y a %s)",
+		"Uploader battery %d%%":            "Batterie de l'uploader %d%%",
+		"Nightscout %s":                    "Nightscout %s",
+		"Plugins: %s":                      "Plugins : %s",
+		"Units: %s":                        "Unités : %s",
+		"Target range %.1f–%.1f":           "Plage cible %.1f–%.1f",
+		"Alarms below %.1f and above %.1f": "Alarmes sous %.1f et au-dessus de %.1f",
+		"Compression low at %s":            "Hypo de compression à %s",
+		"Log %dg carbs":                    "Saisir %dg de glucides",
+	},
+	"it": {
+		"Refresh":                          "Aggiorna",
+		"Snooze alerts for 30 minutes":     "Silenzia gli avvisi per 30 minuti",
+		"Show current value":               "Mostra valore attuale",
+		"Quit":                             "Esci",
+		"Open in browser":                  "Apri nel browser",
+		"Generate report":                  "Genera report",
+		"Alerts":                           "Avvisi",
+		"Predicted low":                    "Basso previsto",
+		"Low":                              "Basso",
+		"Falling fast":                     "In rapida discesa",
+		"Urgent high":                      "Alto urgente",
+		"Rising fast":                      "In rapida salita",
+		"Failed to get BG direction. %.1f": "Impossibile ottenere la tendenza della glicemia. %.1f",
+		"Rising fast! %.1f %s":             "In rapida salita! %.1f %s",
+		"Falling fast! %.1f %s":            "In rapida discesa! %.1f %s",
+		"Low! %.1f %s":                     "Basso! %.1f %s",
+		"Urgent high! %.1f %s":             "Alto urgente! %.1f %s",
+		"Predicted low at %s!":             "Basso previsto alle %s!",
+		"Previous bg":                      "Glicemia precedente",
+		"Low at":                           "Basso alle",
+		"In range at":                      "Nel range alle",
+		"Rate":                             "Variazione",
+		"low at %s":                        "basso alle %s",
+		"in range at %s":                   "nel range alle %s",
+		"%s ago":                           "%s fa",
+		"%dh %dm":                          "%d h %d min",
+		"Clock is %s behind the server":    "L'orologio è indietro di %s rispetto al server",
+		"Clock is %s ahead of the server":  "L'orologio è avanti di %s rispetto al server",
+		"Uploader clock is %s ahead":       "L'orologio dell'uploader è avanti di %s",
+		"(cached, %s old)":                 "(in cache, %s fa)",
+		"Snooze 30m":                       "Silenzia 30 min",
+		"Open Nightscout":                  "Apri Nightscout",
+		"Possible compression low":         "Possibile basso da compressione",
+		"Sensor noise":                     "Rumore del sensore",
+		"Stale data":                       "Dati non aggiornati",
+		"Loop failure":                     "Loop non attivo",
+		"No readings for %s":               "Nessuna lettura da %s",
+		"Loop hasn't run for %s":           "Il loop non gira da %s",
+		"Last treatment %s ago":            "Ultimo trattamento %s fa",
+		"Alert history":                    "Cronologia avvisi",
+		"No alerts yet":                    "Nessun avviso finora",
+		"Export…":                          "Esporta…",
+		"acknowledged":                     "confermato",
+		"snoozed":                          "posticipato",
+		"silenced":                         "silenziato",
+		"Server":                           "Server",
+		"Use server thresholds":            "Usa le soglie del server",
+		"API unreachable: %s":              "API non raggiungibile: %s",
+		"API reachable, %d ms":             "API raggiungibile, %d ms",
+		"Last upload %s (%s ago)":          "Ultimo caricamento %s (%s fa)",
+		"Uploader battery %d%%":            "Batteria uploader %d%%",
+		"Nightscout %s":                    "Nightscout %s",
+		"Plugins: %s":                      "Plugin: %s",
+		"Units: %s":                        "Unità: %s",
+		"Target range %.1f–%.1f":           "Intervallo obiettivo %.1f–%.1f",
+		"Alarms below %.1f and above %.1f": "Allarmi sotto %.1f e sopra %.1f",
+		"Compression low at %s":            "Basso da compressione alle %s",
+		"Log %dg carbs":                    "Registra %dg di carboidrati",
+	},
+	"nl": {
+		"Refresh":                          "Vernieuwen",
+		"Snooze alerts for 30 minutes":     "Meldingen 30 minuten uitstellen",
+		"Show current value":               "Huidige waarde tonen",
+		"Quit":                             "Afsluiten",
+		"Open in browser":                  "Openen in browser",
+		"Generate report":                  "Rapport maken",
+		"Alerts":                           "Meldingen",
+		"Predicted low":                    "Laag voorspeld",
+		"Low":                              "Laag",
+		"Falling fast":                     "Snel dalend",
+		"Urgent high":                      "Urgent hoog",
+		"Rising fast":                      "Snel stijgend",
+		"Failed to get BG direction. %.1f": "Kon de richting van de glucose niet ophalen. %.1f",
+		"Rising fast! %.1f %s":             "Snel stijgend! %.1f %s",
+		"Falling fast! %.1f %s":            "Snel dalend! %.1f %s",
+		"Low! %.1f %s":                     "Laag! %.1f %s",
+		"Urgent high! %.1f %s":             "Urgent hoog! %.1f %s",
+		"Predicted low at %s!":             "Laag voorspeld om %s!",
+		"Previous bg":                      "Vorige glucose",
+		"Low at":                           "Laag om",
+		"In range at":                      "Binnen bereik om",
+		"Rate":                             "Verandering",
+		"low at %s":                        "laag om %s",
+		"in range at %s":                   "binnen bereik om %s",
+		"%s ago":                           "%s geleden",
+		"%dh %dm":                          "%d u %d min",
+		"Clock is %s behind the server":    "De klok loopt %s achter op de server",
+		"Clock is %s ahead of the server":  "De klok loopt %s voor op de server",
+		"Uploader clock is %s ahead":       "De klok van de uploader loopt %s voor",
+		"(cached, %s old)":                 "(opgeslagen, %s oud)",
+		"Snooze 30m":                       "30 min uitstellen",
+		"Open Nightscout":                  "Nightscout openen",
+		"Possible compression low":         "Mogelijk compressielaag",
+		"Sensor noise":                     "Sensorruis",
+		"Stale data":                       "Verouderde gegevens",
+		"Loop failure":                     "Loop storing",
+		"No readings for %s":               "Al %s geen metingen",
+		"Loop hasn't run for %s":           "Loop draait al %s niet",
+		"Last treatment %s ago":            "Laatste behandeling %s geleden",
+		"Alert history":                    "Meldingsgeschiedenis",
+		"No alerts yet":                    "Nog geen meldingen",
+		"Export…":                          "Exporteren…",
+		"acknowledged":                     "bevestigd",
+		"snoozed":                          "gesluimerd",
+		"silenced":                         "onderdrukt",
+		"Server":                           "Server",
+		"Use server thresholds":            "Servergrenzen gebruiken",
+		"API unreachable: %s":              "API onbereikbaar: %s",
+		"API reachable, %d ms":             "API bereikbaar, %d ms",
+		"Last upload %s (%s ago)":          "Laatste upload %s (%s geleden)",
+		"Uploader battery %d%%":            "Uploaderbatterij %d%%",
+		"Nightscout %s":                    "Nightscout %s",
+		"Plugins: %s":                      "Plugins: %s",
+		"Units: %s":                        "Eenheden: %s",
+		"Target range %.1f–%.1f":           "Doelbereik %.1f–%.1f",
+		"Alarms below %.1f and above %.1f": "Alarmen onder %.1f en boven %.1f",
+		"Compression low at %s":            "Compressielaag om %s",
+		"Log %dg carbs":                    "%dg koolhydraten invoeren",
+	},
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const libreFactoryTimestamp = "1/2/2006 3:04:05 PM"
+const libreServer = "https://api.libreview.io"
+const libreVersion = "4.12.0"
+
+// libreTrends maps LibreLinkUp trend arrows onto nightscout directions.
+var libreTrends = map[int]string{
+	0: "None",
+	1: "SingleDown",
+	2: "FortyFiveDown",
+	3: "Flat",
+	4: "FortyFiveUp",
+	5: "SingleUp",
+}
+
+type libreSource struct {
+	server    string
+	username  string
+	password  string
+	patient   string
+	token     string
+	accountId string
+	patientId string
+	mutex     sync.Mutex
+}
+
+type libreResponse struct {
+	Status int             `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type libreLogin struct {
+	Redirect bool   `json:"redirect"`
+	Region   string `json:"region"`
+	User     struct {
+		Id string `json:"id"`
+	} `json:"user"`
+	AuthTicket struct {
+		Token string `json:"token"`
+	} `json:"authTicket"`
+}
+
+type libreConnection struct {
+	PatientId string `json:"patientId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type libreMeasurement struct {
+	FactoryTimestamp string `json:"FactoryTimestamp"`
+	ValueInMgPerDl   int    `json:"ValueInMgPerDl"`
+	TrendArrow       int    `json:"TrendArrow"`
+}
+
+type libreGraph struct {
+	Connection struct {
+		GlucoseMeasurement libreMeasurement `json:"glucoseMeasurement"`
+	} `json:"connection"`
+	GraphData []libreMeasurement `json:"graphData"`
+}
+
+func newLibreSource(username string, password string, region string, server string, patient string) (*libreSource, error) {
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("A LibreLinkUp email and password are required")
+	}
+	if server == "" {
+		server = libreServer
+		if region != "" {
+			server = fmt.Sprintf("https://api-%s.libreview.io", region)
+		}
+	}
+	return &libreSource{
+		server:   server,
+		username: username,
+		password: password,
+		patient:  patient,
+	}, nil
+}
+
+func (s *libreSource) request(method string, path string, body interface{}, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.server+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("product", "llu.android")
+	req.Header.Set("version", libreVersion)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		req.Header.Set("account-id", s.accountId)
+	}
+	resp, err := sourceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.token = ""
+		return fmt.Errorf("LibreLinkUp session expired")
+	}
+	var r libreResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("Unexpected LibreLinkUp response: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || r.Status != 0 {
+		return fmt.Errorf("LibreLinkUp request failed: %s %d %s", resp.Status, r.Status, r.Error.Message)
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// login authenticates, following the region redirect the global server sends
+// for accounts hosted elsewhere, and picks the patient to follow.
+func (s *libreSource) login() error {
+	credentials := map[string]string{
+		"email":    s.username,
+		"password": s.password,
+	}
+	var l libreLogin
+	if err := s.request("POST", "/llu/auth/login", credentials, &l); err != nil {
+		return err
+	}
+	if l.Redirect {
+		s.server = fmt.Sprintf("https://api-%s.libreview.io", l.Region)
+		l = libreLogin{}
+		if err := s.request("POST", "/llu/auth/login", credentials, &l); err != nil {
+			return err
+		}
+	}
+	if l.AuthTicket.Token == "" {
+		return fmt.Errorf("LibreLinkUp login did not return a token")
+	}
+	s.token = l.AuthTicket.Token
+	s.accountId = fmt.Sprintf("%x", sha256.Sum256([]byte(l.User.Id)))
+
+	var connections []libreConnection
+	if err := s.request("GET", "/llu/connections", nil, &connections); err != nil {
+		return err
+	}
+	for _, c := range connections {
+		name := strings.TrimSpace(c.FirstName + " " + c.LastName)
+		if s.patient == "" || strings.EqualFold(s.patient, name) || strings.EqualFold(s.patient, c.FirstName) || s.patient == c.PatientId {
+			s.patientId = c.PatientId
+			return nil
+		}
+	}
+	if s.patient == "" {
+		return fmt.Errorf("No LibreLinkUp connections found")
+	}
+	return fmt.Errorf("No LibreLinkUp connection named %q", s.patient)
+}
+
+func (s *libreSource) graph() (g libreGraph, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.token == "" {
+			if err = s.login(); err != nil {
+				return
+			}
+		}
+		if err = s.request("GET", "/llu/connections/"+s.patientId+"/graph", nil, &g); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (m libreMeasurement) reading() (reading, error) {
+	t, err := time.Parse(libreFactoryTimestamp, m.FactoryTimestamp)
+	if err != nil {
+		return reading{}, err
+	}
+	direction, ok := libreTrends[m.TrendArrow]
+	if !ok {
+		direction = fallbackDirection
+	}
+	return reading{
+		Timestamp: t.UnixNano() / int64(time.Millisecond),
+		Mgdl:      m.ValueInMgPerDl,
+		Direction: direction,
+	}, nil
+}
+
+func (s *libreSource) latest() (reading, error) {
+	g, err := s.graph()
+	if err != nil {
+		return reading{}, err
+	}
+	return g.Connection.GlucoseMeasurement.reading()
+}
+
+// history is limited by LibreLinkUp to the graph of the last 12 hours, which
+// has no trend arrows.
+func (s *libreSource) history(since time.Time) ([]reading, error) {
+	g, err := s.graph()
+	if err != nil {
+		return nil, err
+	}
+	var readings []reading
+	for _, m := range append(g.GraphData, g.Connection.GlucoseMeasurement) {
+		r, err := m.reading()
+		if err != nil {
+			return nil, err
+		}
+		if r.Timestamp > since.UnixNano()/int64(time.Millisecond) {
+			readings = append(readings, r)
+		}
+	}
+	return readings, nil
+}
+
+func (s *libreSource) interval() time.Duration {
+	return time.Minute
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// journaldPriorities are the syslog priorities of each level.
+var journaldPriorities = []int{7, 6, 4, 3}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// logFileSize is how big the log file gets before it's rotated, keeping
+// logFileBackups old files.
+const logFileSize = 10 << 20
+const logFileBackups = 3
+
+// logSink writes one log entry. fields are key value pairs, already checked
+// to come in pairs.
+type logSink interface {
+	write(t time.Time, level logLevel, msg string, fields []interface{}) error
+}
+
+var (
+	logMutex    sync.Mutex
+	logMinLevel         = levelInfo
+	logOutput   logSink = &writerSink{w: os.Stderr}
+)
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("Unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// setupLogging sends logs where the -log flags say. Falling back to stderr
+// rather than failing means the tray still starts in containers and on
+// systems without syslog or journald.
+func setupLogging() {
+	level, err := parseLogLevel(*args.LogLevel)
+	if err != nil {
+		logWarn(err.Error())
+	}
+	if *args.Debug {
+		level = levelDebug
+	}
+	var sink logSink
+	switch *args.Log {
+	case "", "stderr":
+	case "file":
+		name := *args.LogFile
+		if name == "" {
+			name, err = defaultLogFile()
+		}
+		if err == nil {
+			sink, err = newFileSink(name)
+		}
+	case "journald":
+		sink, err = newJournaldSink()
+	case "syslog":
+		sink, err = newSyslogSink()
+	default:
+		err = fmt.Errorf("Unknown log output %q, expected stderr, file, journald or syslog", *args.Log)
+	}
+	logMutex.Lock()
+	logMinLevel = level
+	if sink != nil {
+		logOutput = sink
+	}
+	logMutex.Unlock()
+	if err != nil {
+		logWarn("Logging to stderr instead", "err", err)
+	}
+	// Anything still using the standard logger, including libraries, is
+	// logged as a warning.
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+// logToStderr is for the command line modes, where errors should be seen by
+// whoever ran them.
+func logToStderr() {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput = &writerSink{w: os.Stderr}
+}
+
+func logDebug(msg string, fields ...interface{}) { logAt(levelDebug, msg, fields) }
+func logInfo(msg string, fields ...interface{})  { logAt(levelInfo, msg, fields) }
+func logWarn(msg string, fields ...interface{})  { logAt(levelWarn, msg, fields) }
+func logError(msg string, fields ...interface{}) { logAt(levelError, msg, fields) }
+
+// logFatal logs an error and exits.
+func logFatal(msg string, fields ...interface{}) {
+	logAt(levelError, msg, fields)
+	os.Exit(1)
+}
+
+func logAt(level logLevel, msg string, fields []interface{}) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if level < logMinLevel {
+		return
+	}
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+	if err := logOutput.write(time.Now(), level, msg, fields); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write log:", err)
+	}
+}
+
+// logfmt formats the fields as key=value pairs, quoting values with spaces.
+func logfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%v=%s", fields[i], logValue(fields[i+1]))
+	}
+}
+
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logLine is an entry as a logfmt line, for stderr and files.
+func logLine(t time.Time, level logLevel, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	logfmt(&buf, append([]interface{}{"time", t.Format(time.RFC3339), "level", levelNames[level], "msg", msg}, fields...))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) write(t time.Time, level logLevel, msg string, fields []interface{}) error {
+	_, err := s.w.Write(logLine(t, level, msg, fields))
+	return err
+}
+
+// fileSink writes to a file that's rotated when it gets big.
+type fileSink struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// defaultLogFile is $XDG_STATE_HOME/cgm/cgm.log, rather than the working
+// directory, which is usually $HOME or / when started by autostart.
+func defaultLogFile() (string, error) {
+	dir, err := xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cgm.log"), nil
+}
+
+func newFileSink(name string) (logSink, error) {
+	s := &fileSink{name: name}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) write(t time.Time, level logLevel, msg string, fields []interface{}) error {
+	if s.size >= logFileSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(logLine(t, level, msg, fields))
+	s.size += int64(n)
+	return err
+}
+
+// rotate moves cgm.log to cgm.log.1, cgm.log.1 to cgm.log.2 and so on,
+// dropping the oldest.
+func (s *fileSink) rotate() error {
+	s.file.Close()
+	for i := logFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.name, i), fmt.Sprintf("%s.%d", s.name, i+1))
+	}
+	if err := os.Rename(s.name, s.name+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// journaldSink sends entries with their fields over journald's native
+// protocol, so they can be filtered with e.g. journalctl PROFILE=Sam.
+type journaldSink struct {
+	conn *net.UnixConn
+}
+
+func newJournaldSink() (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn}, nil
+}
+
+func (s *journaldSink) write(t time.Time, level logLevel, msg string, fields []interface{}) error {
+	var buf bytes.Buffer
+	var text bytes.Buffer
+	text.WriteString(msg)
+	logfmt(&text, fields)
+	journaldField(&buf, "MESSAGE", text.String())
+	journaldField(&buf, "PRIORITY", strconv.Itoa(journaldPriorities[level]))
+	journaldField(&buf, "SYSLOG_IDENTIFIER", "cgm")
+	for i := 0; i < len(fields); i += 2 {
+		if key := journaldKey(fmt.Sprint(fields[i])); key != "" {
+			journaldField(&buf, key, fmt.Sprint(fields[i+1]))
+		}
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// journaldField appends a field, using the length prefixed form for values
+// with newlines.
+func journaldField(buf *bytes.Buffer, key string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key + "\n")
+	size := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		buf.WriteByte(byte(size >> (8 * i)))
+	}
+	buf.WriteString(value + "\n")
+}
+
+// journaldKey converts a field name to the upper case letters, digits and
+// underscores journald allows.
+func journaldKey(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(key) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return strings.TrimLeft(b.String(), "_0123456789")
+}
+
+// stdLogWriter sends the standard logger's output through logWarn.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logWarn(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "fmt"
+
+func newSyslogSink() (logSink, error) {
+	return nil, fmt.Errorf("Syslog isn't available on Windows")
+}
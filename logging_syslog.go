@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/syslog"
+	"time"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "CGM")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to syslog: %s", err)
+	}
+	return &syslogSink{w}, nil
+}
+
+func (s *syslogSink) write(t time.Time, level logLevel, msg string, fields []interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	logfmt(&buf, fields)
+	text := buf.String()
+	switch level {
+	case levelDebug:
+		return s.w.Debug(text)
+	case levelInfo:
+		return s.w.Info(text)
+	case levelWarn:
+		return s.w.Warning(text)
+	}
+	return s.w.Err(text)
+}
@@ -4,32 +4,32 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"log/syslog"
-	"math"
-	"net/http"
-	"os"
-	"os/exec"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/gen2brain/beeep"
 	"github.com/getlantern/systray"
 )
 
 const mgdltommol = 18.018018018
 const predictLowSeconds = 3600
+const staleSeconds = 900
+
+// dbTimeout is how long to wait for another process to release cgm.db.
+const dbTimeout = 5 * time.Second
 
 type bg struct {
-	Direction          direction
-	LastBgAlert        string
-	LastDirectionAlert string
-	PreviousValue      bgValue
-	Value              bgValue
+	Direction             direction
+	LastBgAlert           string
+	LastBgAlertTime       int64
+	LastDirectionAlert    string
+	LastPredictedLowAlert int64
+	LoopAlerted           bool
+	RateAlerts            map[string]bool
+	StaleAlerted          bool
+	PreviousValue         bgValue
+	Value                 bgValue
 }
 
 type bgValue struct {
@@ -45,10 +45,31 @@ type direction struct {
 }
 
 type flags struct {
-	Url        *string
-	Urgenthigh *float64
-	High       *float64
-	Low        *float64
+	Carbs        *int
+	Config       *string
+	Dbus         *bool
+	Debug        *bool
+	DelayLows    *bool
+	HttpAddr     *string
+	Log          *string
+	LogFile      *string
+	LogLevel     *string
+	MetricsAddr  *string
+	MqttBroker   *string
+	Person       *string
+	Preset       *string
+	Source       *string
+	Title        *string
+	Url          *string
+	Token        *string
+	Username     *string
+	Password     *string
+	Region       *string
+	Patient      *string
+	Urgenthigh   *float64
+	High         *float64
+	Low          *float64
+	WeeklyReport *bool
 }
 
 type icon struct {
@@ -57,21 +78,42 @@ type icon struct {
 }
 
 var (
-	alertValues = map[string]bool{}
-	alertKeys   = []string{
+	alertKeys = []string{
 		"Predicted low",
 		"Low",
 		"Falling fast",
 		"Urgent high",
 		"Rising fast",
+		"Stale data",
+		"Loop failure",
 	}
 	args = flags{
-		Url:        flag.String("url", "", "Your nightscout url e.g. https://example.herokuapp.com"),
-		Urgenthigh: flag.Float64("urgent-high", 15.0, "Your BG urgent high target"),
-		High:       flag.Float64("high", 8.0, "Your BG high target"),
-		Low:        flag.Float64("low", 4.0, "Your BG low target"),
+		Carbs:        flag.Int("carbs", 15, "Grams of carbs the Log carbs action on alerts records in nightscout"),
+		Config:       flag.String("config", "", "Path to a JSON config file of profiles and notifiers"),
+		Dbus:         flag.Bool("dbus", true, "Provide the org.nightscout.Systray D-Bus service"),
+		Debug:        flag.Bool("debug", false, "Log at debug level, including fetch scheduling decisions"),
+		DelayLows:    flag.Bool("delay-compression-lows", false, "Wait for the next reading before alerting on a suspected compression low"),
+		HttpAddr:     flag.String("http", "", "Serve the current reading as JSON on this localhost address e.g. localhost:17580"),
+		Log:          flag.String("log", "stderr", "Where to log: stderr, file, journald or syslog"),
+		LogFile:      flag.String("log-file", "", "Log file for -log file, rotated at 10MB (default $XDG_STATE_HOME/cgm/cgm.log)"),
+		LogLevel:     flag.String("log-level", "info", "Least severe level to log: debug, info, warn or error"),
+		MetricsAddr:  flag.String("metrics", "", "Serve Prometheus metrics on this address e.g. :9580"),
+		MqttBroker:   flag.String("mqtt", "", "Publish readings and alerts to this MQTT broker e.g. tcp://localhost:1883"),
+		Person:       flag.String("person", "", "Name of the person being followed, shown in alerts"),
+		Preset:       flag.String("preset", "", "Alert defaults to start from: caregiver"),
+		Url:          flag.String("url", "", "Your nightscout url e.g. https://example.herokuapp.com"),
+		Token:        flag.String("token", "", "Your nightscout access token, if the site requires one"),
+		Title:        flag.String("title", defaultTitleTemplate, "Template for the tray title, see the README for the fields"),
+		Source:       flag.String("source", "nightscout", "Where to read BG from: nightscout, dexcom or libre"),
+		Username:     flag.String("username", "", "Your Dexcom Share username or LibreLinkUp email"),
+		Password:     flag.String("password", "", "Your Dexcom Share or LibreLinkUp password"),
+		Region:       flag.String("region", "", "Your Dexcom Share region (us or ous) or LibreLinkUp region (e.g. eu)"),
+		Patient:      flag.String("patient", "", "The LibreLinkUp connection to follow (default the first)"),
+		Urgenthigh:   flag.Float64("urgent-high", 15.0, "Your BG urgent high target"),
+		High:         flag.Float64("high", 8.0, "Your BG high target"),
+		Low:          flag.Float64("low", 4.0, "Your BG low target"),
+		WeeklyReport: flag.Bool("weekly-report", false, "Generate a report automatically every Sunday night"),
 	}
-	currentBg  *systray.MenuItem
 	directions = map[string]direction{
 		"TripleUp": {
 			Value:      "⤊",
@@ -146,31 +188,54 @@ var (
 			Base64: "iVBORw0KGgoAAAANSUhEUgAAAlgAAAJYCAYAAAC+ZpjcAAAABmJLR0QA/wD/AP+gvaeTAAANmUlEQVR42u3dzXXbSBCF0cbk5IXDciQOywsH5VnMnCPJFEX8FIDqqnsjMClZ/vy6CY0BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAECsxVsARPv98/ufmf6833788rMQEFiAcBJigMACRJT4AgQWIKQQXoDAAsSU6AIEFiCmEF0gsABBheACBBYIKgQXILAAQYXgAoEFCCoEFyCwQFQhtgCBBaIKxBYILEBUIbZAYAGiCrEFCCwQVSC2QGCBqAKxBQILEFYILUBggagCsQUCC4QVCC0QWCCqALEFAguEFQgtEFggrEBogcACYQUILRBYIKxAaIHAAlEFQgsEFogrQGghsEBYAUILBBYIKxBaILBAWAFCC4EFwgoQWiCwEFaA0AKBBcIKEFoILBBWgNACgYW4AkQWCCwQVoDQQmCBsAKEFggsxBUgskBgIawAhBYCC8QVILIQWCCsAKEFAgthBSC0EFggrgCRhcACYQUILRBYiCsAkYXAQlwBiCwEFggrQGiBwEJcASJLZCGwEFYAQguBBeIKEFkILG8B4goQWSCwEFYAQguBhbgCEFkILBBXgMgCgYWwAhBaCCzEFYDIQmCBuAJEFggsxBWAyEJgIawAhBYCC3EFILJAYCGuAEQWAgtxBSCyEFiIKwCRhcACcQUgshBYiCsAkYXAQlgBCC0EFuIKAJGFwEJcAYgsBBbiCkBkIbAQVwCILAQW4gpAZCGwEFcAIguBhbgCQGQhsMQVACILgYW4AhBZCCzEFQAiS2AhrgAQWQgsxBWAyEJgIa4AEFkCC3EFgMhCYIkr7wKAyEJgIa4AEFkCC3EFgMjiuX+8BQAAsVRyAdYrgFqsWAILcQWAyEJgiSsARBYCC3EFILIQWIgrAESWwEJcASCyEFjiCgCRRVaegwUAEEwJT8J6BcAYViyBhbgCQGQJLMQVACILgSWuABBZJOSSOwBAMOWblPUKgDWsWAILcQWAyBJYiCsARBbbuYMFABBM7SZivQLgCCuWwEJcASCyBBbiCgCRxTruYAEABFO4N7NeAXAGK5bAElcAILJKcUQIABBM2d7EegXAFaxYAktcAYDIEliIKwBEFo/cwQIACKZmL2S9AuBOViyBJa4AQGRNyxEhAEAwFXsB6xUAmVixzmfBAgAIpmBPZr0CICMrlsASVwAgsqbiiBAAIJhyPYn1CoAZWLEElrgCAJE1BUeEAADBFGsw6xUAM7JixbJgAQAEU6uBrFcAzMyKFceCJa4AAIEFAJzBWBDHFOgbEgA+cFR4nAULACCYQj3IegVARVasYyxYAADB1OkB1isAKrNi7WfBAgAIpkx3sl4B0IEVax8LFgBAMFW6g/UKgE6sWNtZsAAAginSjaxXAHRkxdrGggUAEEyNbmC9AqAzK9Z6FixxBQAILADgDsYGgQUAcBtnqYodADZxF+s1CxYAQDAF+oL1CgAeWbG+ZsECAAimPr9gvQKA56xYz1mwAACCKc8nrFcA8JoV63MWLACAYKrzE9YrAFjPivXIggUAILAAAHIz6f3F8SAAbOeY8CMLFgBAMLX5jvUKAPazYr2xYAEACCwAgNxMef9zPAgAxzkm/I8FCwAgmMoc1isAiGTFsmABAAgsAIDs2k94jgcBIF73Y0ILFgCAwAIAyK31fOd4EADO0/mY0IIFACCwAAByazvdOR4EgPN1PSa0YAEACCwAgNxaznaOBwHgOh2PCS1YAAACCwAgt3aTneNBALhet2NCCxYAgMACAMit1VzneBAA7tPpmNCCBQAgsAAABBYAQCttzkLdvwKA+3W5h2XBAgAQWAAAAgsAoJUW56DuXwFAHh3uYVmwAAAEFgCAwAIAaKX8Gaj7VwCQT/V7WBYsAACBBQAgsAAAWil9/un+FQDkVfkelgULAEBgAQAILAAAgQUAwH5lL5e54A4A+VW96G7BAgAQWAAAAgsAQGABALBfyYtlLrgDwDwqXnS3YAEACCwAAIEFACCwAAAQWAAAaZS7te8ThAAwn2qfJLRgAQAILAAAgQUAILAAABBYAAACCwCgqlIfifSIBgCYV6VHNViwAAAEFgCAwAIAEFgAAAgsAACBBQAgsAAAEFgAAALrAA8ZBQAEFgDAO5XGEoEFACCwAAAEFgCAwAIAQGABAAgsAACBBQCAwAIAEFgAAAILAACBBQAgsAAABBYAgMACAEBgAQAILAAAgQUAgMACABBYAAACCwAAgQUAILAAAAQWAAACCwBAYAEACCwAAIEFAIDAAgAQWAAAAgsAAIEFACCwAAAEFgAAAgsAQGABAAgsAAAEFgCAwAIAEFgAAAILAACBBQAgsAAABBYAAAILAJjNtx+/FoHliwIAUDuwAAAEFgCAwAIAQGABAAgsAACBBQCAwAIAEFgAAFMp93DO3z+///FlBYC5VHtguAULAEBgAQAILAAAgQUAgMACABBYAABVLRVflEc1AMA8qj2iYQwLFgCAwAIAEFgAAAILAACBBQCQyFL1hfkkIQDkV/EThGNYsAAABBYAgMACABBYAAAcsVR+cS66A0BeVS+4j2HBAgAQWAAAAgsAQGABAHDEUv0FuugOAPlUvuA+hgULAEBgAQAILACAZpYOL9I9LADIo/r9qzEsWAAAAgsAQGABADSzdHmh7mEBwP063L8aw4IFACCwAAAEFgBAM0unF+seFgDcp8v9qzEsWAAAAgsAQGABAO11Oh5sF1jdvrgAgMACABBYAAA8anlk5nENAHCdjld0LFgAAAILACC3tp+qc0wIAOfr+gl+CxYAgMACAMit9YM3HRMCwHk6P+DbggUAILAAAHJr/7v5HBMCQLzuv//XggUAILAAAHJbvAWOCQEgUvfjwTEsWAAAAgsAyMt6JbB8MwAAAgsAYAaWm3dcdgeA/ZwIvbFgAQAILACA3Ex5f3FMCADbOR78yIIFABBMbX7CigUA61mvHlmwAAAEFgBAbia9JxwTAsBrjgc/Z8ECAAimOr9gxQKA56xXz1mwAACCKc8XrFgA8Mh69TULFgBAMPW5ghULAN5Yr16zYAEABFOgK1mxAMB6tZYFCwAgmArdwIoFQGfWq/UsWAAAwZToRlYsADqyXm1jwQIACKZGd7BiAdCJ9Wo7CxYAQDBFupMVC4AOrFf7WLAAAIKp0gOsWABUZr3az4IFABBMmR5kxQKgIuvVMRYsAIBg6jSAFQuASqxXx1mwAACCKdQgViwAKrBexbBgAQDiSmD5pgQAchMFwRwVAjAjQ0EsCxYAQDC1egIrFgAzsV7Fs2ABAARTrCexYgEwA+uVwBJZACCupuCIEAAgmHI9mRULgIysVwJLZAGAuJqKI0IAgGAK9iJWLAAysF5dw4IFABBMxV7IigXAnaxXAktkAYC4mpYjQgCAYGr2BlYsAK5kvRJYIgsAxJXAQmQBIK74yB0sAIBgyvZmViwAzmC9ElgiS2QBIK5KcUQIABBM4SZhxQIggvVKYCGyABBXAguRBYC44jV3sAAAgqndhKxYAGxhvRJYiCwAxJXAQmQBIK7Yxh0sAIBgyjc5KxYAn7FeCSxEFgDiSmAhsgAQVwgskQWAuCINl9wBQFwhsPzlAgBy8w/2hBwVAvgPNgILkQWAuBJYiCwAxBUCS2QBIK4QWIgsAMSVwEJkASCuWMVjGgAAgqnkQqxYAHOzXgksRBYA4gqBJbIAEFcILEQWgLhCYCGyABBXCCyRBYC4QmAhsgDEFQILkQWAuBJYiCwAxBUCC5EFIK4QWIgsAHGFwEJkASCuEFiILABxhcBCZAGIKwQWIgsAcYXAQmQBiCsEFiILQFwhsBBaAMIKgQUiC0BcIbAQWQDiCoGFyAIQVwgsEFkA4gqBhcgCEFcILEQWgLBCYIHQAsQVCCxEFoC4QmAhsgDEFQILkQUgrEBgIbQAxBUCC5EFIK4QWIgsAHGFwAKhBQgrEFiILABxhcBCZAGIKwQWCC1AWIHAQmQBiCsEFkILQFghsEBkAeIKBBYiCxBXILAQWgDCCoEFIgsQVyCwEFqAsAKBhdACEFYILBBZgLhCYIHQAoQVCCxEFiCuQGCB0AKEFQILhBYgrEBgIbQAYQUCC0QWIK4QWCC0AGEFAguhBQgrEFggtEBYgcACoQUIKxBYCC1AWIHAAqEFwgoEFggtEFYgsEBoAcIKBBYILRBWILBAaIGwAoEFQgsQViCwQGiBsAKBBWILRBUILBBaIKwAgQViC0QVCCwQWiCqQGABYgthBQILEFuIKkBggdgCUQUCCxBbiCoQWIDYQlQBAgvEFoIKEFiA4EJUgcACBBeCChBYILgQVIDAAgSXoAIEFiC6EFOAwAJEl5gCBBYgvIQUILAA8SWiAIEF0DfEhBMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEB2/wKPSozC4cSK/wAAAABJRU5ErkJggg==",
 		},
 	}
-	inRangeAt   *systray.MenuItem
-	inRangeTime time.Time
-	lastBg      bg
-	lowAt       *systray.MenuItem
-	lowTime     time.Time
-	previousBg  *systray.MenuItem
+	profiles []*profile
+	// render shows the readings after each refresh: in the tray, or on
+	// stdout in bar mode.
+	render = func() {}
+	// readingHooks are called with the profile whenever a new reading
+	// arrives.
+	readingHooks []func(p *profile)
+	// sendAlerts is off in bar mode unless asked for, since the tray is
+	// usually running too and would send the same alerts.
+	sendAlerts  = true
+	setBgMutex  sync.Mutex
 	showBg      bool
+	showCurrent *systray.MenuItem
+	snoozeUntil time.Time
 )
 
 func main() {
-	syslog, err := syslog.New(syslog.LOG_INFO, "CGM")
-	if err != nil {
-		panic("Unable to connect to syslog")
-	}
-	log.SetOutput(syslog)
-
 	flag.Parse()
+	setupLogging()
 
-	if *args.Url == "" {
-		log.Fatal("A nightscout URL is required")
+	if err := loadConfig(); err != nil {
+		logFatal("Invalid config", "err", err)
+	}
+
+	switch flag.Arg(0) {
+	case "bar":
+		runBar(flag.Args()[1:])
+		return
+	case "now":
+		runNow(flag.Args()[1:])
+		return
 	}
 
-	db, err := bolt.Open("cgm.db", 0600, nil)
+	// Only one process can have the db open, so fail clearly rather than
+	// waiting forever when the tray is already running.
+	db, err := bolt.Open("cgm.db", 0600, &bolt.Options{Timeout: dbTimeout})
+	if err == bolt.ErrTimeout && flag.Arg(0) == "report" {
+		runReport(nil, flag.Args()[1:])
+		return
+	}
+	if err == bolt.ErrTimeout {
+		if flag.Arg(0) != "" {
+			logFatal("cgm.db is in use by the running tray, stop it first", "command", flag.Arg(0))
+		}
+		logFatal("cgm.db is in use, the tray is probably already running")
+	}
 	if err != nil {
-		log.Fatal("Failed to initialse DB")
+		logFatal("Failed to initialise DB", "err", err)
 	}
 	defer db.Close()
 
@@ -187,320 +252,225 @@ func main() {
 		return nil
 	})
 	if err != nil {
-		log.Fatal(err)
+		logFatal("Failed to initialise DB", "err", err)
+	}
+
+	if flag.Arg(0) == "report" {
+		runReport(db, flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "alerts" {
+		runAlertExport(db, flag.Args()[1:])
+		return
+	}
+
+	for _, p := range profiles {
+		go func(p *profile) {
+			if err := p.backfillHistory(db); err != nil {
+				logWarn("Failed to backfill history", "profile", p.logName(), "err", err)
+			}
+		}(p)
+	}
+	if *args.WeeklyReport {
+		go scheduleWeeklyReport(db)
+	}
+	if *args.HttpAddr != "" {
+		go serve(db, *args.HttpAddr)
+	}
+	if *args.MetricsAddr != "" {
+		go serveMetrics(*args.MetricsAddr)
+	}
+	if *args.MqttBroker != "" || mqttSettings.Broker != "" {
+		startMqtt()
 	}
 
 	systray.Run(func() {
-		currentBg = systray.AddMenuItem("", "")
-		if showBg {
-			currentBg.Hide()
+		for _, p := range profiles {
+			p.addMenu(db, len(profiles) > 1)
 		}
-		inRangeAt = systray.AddMenuItem("", "")
-		inRangeAt.Hide()
-		lowAt = systray.AddMenuItem("", "")
-		lowAt.Hide()
-		previousBg = systray.AddMenuItem("", "")
-		previousBg.Hide()
-		open := systray.AddMenuItem("Open in browser", "")
-		refresh := systray.AddMenuItem("Refresh", "")
-		addAlertSettings(db)
-		showCurrent := systray.AddMenuItemCheckbox("Show current value", "", showBg)
-		quit := systray.AddMenuItem("Quit", "")
+		refresh := systray.AddMenuItem(tr("Refresh"), "")
+		snoozeAlerts := systray.AddMenuItem(tr("Snooze alerts for 30 minutes"), "")
+		showCurrent = systray.AddMenuItemCheckbox(tr("Show current value"), "", showBg)
+		quit := systray.AddMenuItem(tr("Quit"), "")
 		go func() {
 			for {
 				select {
-				case <-open.ClickedCh:
-					exec.Command("xdg-open", *args.Url).Start()
 				case <-refresh.ClickedCh:
-					setBg()
+					setBg(db)
+				case <-snoozeAlerts.ClickedCh:
+					snooze(30 * time.Minute)
 				case <-showCurrent.ClickedCh:
-					toggleShowCurrent(showCurrent, db)
+					setShowCurrent(!showCurrent.Checked(), db)
 				case <-quit.ClickedCh:
 					systray.Quit()
 				}
 			}
 		}()
-		setBg()
-		for range time.Tick(time.Minute * 1) {
-			setBg()
+		if *args.Dbus {
+			startDbus(db)
 		}
+		render = updateTray
+		restoreStates(db)
+		setBg(db)
+		poll(db, subscribe())
 	}, func() {})
 }
 
-func (b *bg) alert() {
-	alerts := b.getAlerts()
-	if len(alerts) < 1 {
-		return
-	}
-	var filename string
-	file, err := ioutil.TempFile("./", "red.png")
-	if err == nil {
-		defer file.Close()
-		img, err := decodedIcon("red")
+func decodedIcon(i string) ([]byte, error) {
+	if len(icons[i].Decoded) < 1 {
+		img, err := base64.StdEncoding.DecodeString(icons[i].Base64)
 		if err != nil {
-			log.Println(err)
-		} else {
-			file.Write(img)
-			filename = file.Name()
+			return []byte(" "), fmt.Errorf("Failed to get icon: %s", i)
+		}
+		icons[i] = icon{
+			Base64:  icons[i].Base64,
+			Decoded: img,
 		}
 	}
 
-	for _, alert := range alerts {
-		beeep.Alert("CGM", alert, filename)
-	}
-	if filename != "" {
-		os.Remove(filename)
-	}
+	return icons[i].Decoded, nil
 }
 
-func (b *bg) format() string {
-	return fmt.Sprintf("%.1f %s", b.Value.Value, b.Direction.Value)
+// iconSeverity orders icons so the tray shows the most urgent state of all
+// followed profiles.
+var iconSeverity = map[string]int{
+	"green":  0,
+	"orange": 1,
+	"red":    2,
 }
 
-func (b *bg) getAlerts() (alerts []string) {
-	if b.Direction.IsFallback {
-		if b.LastDirectionAlert != "failed" {
-			alerts = append(alerts, fmt.Sprintf("Failed to get BG direction. %.1f", b.Value.Value))
-			b.LastDirectionAlert = "failed"
+// polledProfiles returns the profiles that need polling because their source
+// isn't pushing updates.
+func polledProfiles() (polled []*profile) {
+	for _, p := range profiles {
+		if s, ok := p.source.(pusher); !ok || !s.connected() {
+			polled = append(polled, p)
 		}
-	} else if b.Value.Value != b.PreviousValue.Value {
-		if b.Direction.IsRising {
-			if b.LastDirectionAlert != "rising" {
-				if alertValues["Rising fast"] {
-					alerts = append(alerts, fmt.Sprintf("Rising fast! %.1f %s", b.Value.Value, b.Direction.Value))
-					b.LastDirectionAlert = "rising"
+	}
+	return
+}
+
+// subscribe starts listening to every source that pushes readings, returning
+// the channel profiles are sent on when they have a new one. Updates that
+// arrive while one is still waiting are dropped, since a single refresh
+// covers them, so a slow refresh never holds up reading the socket.
+func subscribe() <-chan *profile {
+	updates := make(chan *profile)
+	for _, p := range profiles {
+		if s, ok := p.source.(pusher); ok {
+			pending := make(chan struct{}, 1)
+			go func(p *profile) {
+				for range pending {
+					updates <- p
 				}
-			}
-		} else if b.Direction.IsFalling {
-			if b.LastDirectionAlert != "falling" {
-				if alertValues["Falling fast"] {
-					alerts = append(alerts, fmt.Sprintf("Falling fast! %.1f %s", b.Value.Value, b.Direction.Value))
-					b.LastDirectionAlert = "falling"
+			}(p)
+			go s.subscribe(func() {
+				select {
+				case pending <- struct{}{}:
+				default:
 				}
-			}
+			})
 		}
 	}
+	return updates
+}
 
-	if b.Value.isLow() {
-		if b.LastBgAlert != "low" {
-			if alertValues["Low"] {
-				alerts = append(alerts, fmt.Sprintf("Low! %.1f %s", b.Value.Value, b.Direction.Value))
-				b.LastBgAlert = "low"
-			}
+// setBg refreshes the given profiles, or all of them when none are given, and
+// renders the result.
+func setBg(db *bolt.DB, refresh ...*profile) {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
+
+	if len(refresh) == 0 {
+		refresh = profiles
+	}
+	for _, p := range refresh {
+		previousTimestamp := p.bg.Value.Timestamp
+		err := p.refresh(db)
+		if err != nil {
+			logWarn("Fetch failed", "profile", p.logName(), "err", err)
 		}
-	} else if b.Value.isUrgentHigh() {
-		if b.LastBgAlert != "high" {
-			if alertValues["Urgent High"] {
-				alerts = append(alerts, fmt.Sprintf("Urgent Hight! %.1f %s", b.Value.Value, b.Direction.Value))
-				b.LastBgAlert = "high"
+		p.schedule(err)
+		if p.bg.Value.Timestamp != previousTimestamp {
+			for _, hook := range readingHooks {
+				hook(p)
 			}
 		}
 	}
-
-	if lowTime.After(time.Now()) && lowTime.Before(time.Now().Add(predictLowSeconds*time.Second)) {
-		if alertValues["Predicted low"] {
-			alerts = append(alerts, fmt.Sprintf("Predicted Low at %s!", lowTime.Format("15:04")))
-		}
-		lowAt.SetTitle(fmt.Sprintf("Low at: %s", lowTime.Format("15:04")))
-		lowAt.Show()
-	} else if b.Value.Timestamp != b.PreviousValue.Timestamp {
-		lowAt.Hide()
-	}
-
-	return
+	render()
 }
 
-func (b *bg) getBg() string {
-	url := *args.Url + "/api/v1/entries?count=1"
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Println(err)
+// updateTray shows the latest readings in the tray and menus.
+func updateTray() {
+	for _, p := range profiles {
+		p.updateMenu()
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err)
-	}
-	stringBody := strings.Split(string(body), "\t")
-	timestamp, err := strconv.ParseInt(stringBody[1], 10, 64)
-	if err != nil {
-		log.Println(err)
-	}
-	mgdl, err := strconv.Atoi(stringBody[2])
-	if err != nil {
-		log.Println(err)
-	}
-	direction := strings.ReplaceAll(stringBody[3], "\"", "")
-	_, ok := directions[direction]
-	if !ok {
-		direction = fallbackDirection
-	}
-
-	if b.Value.Timestamp > 0 && b.Value.Timestamp != timestamp {
-		previousBg.SetTitle(fmt.Sprintf("Previous bg: %.1f %s", b.Value.Value, b.Direction.Value))
-	}
-
-	b.Direction = directions[direction]
-	b.PreviousValue = b.Value
-	b.Value = bgValue{
-		Timestamp: timestamp,
-		Value:     float64(mgdl) / mgdltommol,
-	}
-	b.calculateLowTime()
-	b.alert()
-	b.calculateInRangeTime()
-
-	if inRangeTime.After(time.Now()) {
-		inRangeAt.SetTitle(fmt.Sprintf("In range at: %s", inRangeTime.Format("15:04")))
-		inRangeAt.Show()
-	} else if b.Value.Timestamp != b.PreviousValue.Timestamp {
-		inRangeAt.Hide()
-	}
-
-	return b.format()
-}
-
-func (b bg) getIcon() []byte {
-	var i string
-	if b.Value.isLow() || b.Value.isUrgentHigh() {
-		i = "red"
-	} else if b.Value.isHigh() {
-		i = "orange"
-	} else {
-		i = "green"
+	if showBg {
+		systray.SetTitle(trayTitle())
 	}
-
-	img, err := decodedIcon(i)
+	icon, err := decodedIcon(worstIcon())
 	if err != nil {
-		log.Println(err)
+		logError("Failed to decode icon", "err", err)
 	}
-
-	return img
+	systray.SetIcon(icon)
 }
 
-func (b bg) calculateLowTime() {
-	if b.Value.Timestamp != b.PreviousValue.Timestamp {
-		var secondsToLow int
-		if b.Value.Value < b.PreviousValue.Value {
-			seconds := (b.Value.Timestamp - b.PreviousValue.Timestamp) / 1000
-			changePerSecond := (b.PreviousValue.Value - b.Value.Value) / float64(seconds)
-			secondsToLow = int((b.Value.Value - *args.Low) / changePerSecond)
-			lowTime = time.Now().Add(time.Duration(secondsToLow) * time.Second)
-		} else {
-			lowTime = time.Now()
+// worstIcon returns the icon for the most urgent state of all profiles.
+func worstIcon() string {
+	i := "green"
+	for _, p := range profiles {
+		if p.bg.Value.Timestamp == 0 {
+			continue
+		}
+		if pi := p.getIcon(); iconSeverity[pi] > iconSeverity[i] {
+			i = pi
 		}
 	}
+	return i
 }
 
-func (b bg) calculateInRangeTime() {
-	if b.Value.Timestamp != b.PreviousValue.Timestamp {
-		seconds := math.Abs(float64((b.Value.Timestamp - b.PreviousValue.Timestamp) / 1000))
-		changePerSecond := math.Abs((b.PreviousValue.Value - b.Value.Value) / seconds)
-		var secondsToInRange int
-		if b.Value.isHigh() && b.Value.Value < b.PreviousValue.Value {
-			secondsToInRange = int((b.Value.Value - *args.High) / changePerSecond)
-		} else if b.Value.isLow() && b.Value.Value > b.PreviousValue.Value {
-			secondsToInRange = int((*args.Low - b.Value.Value) / changePerSecond)
+// trayTitle combines the current reading of every profile into the tray
+// title.
+func trayTitle() string {
+	var titles []string
+	for _, p := range profiles {
+		if p.bg.Value.Timestamp > 0 {
+			titles = append(titles, p.title())
 		}
-		inRangeTime = time.Now().Add(time.Duration(secondsToInRange) * time.Second)
 	}
+	return strings.Join(titles, " | ")
 }
 
-func (b bgValue) isUrgentHigh() bool {
-	return b.Value >= *args.Urgenthigh
-}
+// snooze silences alert notifications for d.
+func snooze(d time.Duration) {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
 
-func (b bgValue) isHigh() bool {
-	return b.Value >= *args.High
+	snoozeUntil = time.Now().Add(d)
 }
 
-func (b bgValue) isLow() bool {
-	return b.Value < *args.Low
-}
+func setShowCurrent(show bool, db *bolt.DB) {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
 
-func addAlertSettings(db *bolt.DB) {
-	alerts := systray.AddMenuItem("Alerts", "")
-	db.Batch(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte("alerts"))
-		if err != nil {
-			return err
-		}
-		for _, alert := range alertKeys {
-			v := b.Get([]byte(alert))
-			if len(v) == 0 {
-				v = []byte("true")
-			}
-			alertValues[alert] = (string(v) == "true")
-			a := alerts.AddSubMenuItemCheckbox(alert, "", alertValues[alert])
-			go func(alert string) {
-				for {
-					select {
-					case <-a.ClickedCh:
-						if a.Checked() {
-							a.Uncheck()
-						} else {
-							a.Check()
-						}
-						alertValues[alert] = a.Checked()
-						db.Update(func(tx *bolt.Tx) error {
-							v := "false"
-							if a.Checked() {
-								v = "true"
-							}
-							b := tx.Bucket([]byte("alerts"))
-							return b.Put([]byte(alert), []byte(v))
-						})
-					}
-				}
-			}(alert)
-		}
-		return nil
-	})
-}
-
-func decodedIcon(i string) ([]byte, error) {
-	if len(icons[i].Decoded) < 1 {
-		img, err := base64.StdEncoding.DecodeString(icons[i].Base64)
-		if err != nil {
-			return []byte(" "), fmt.Errorf("Failed to get icon: %s", i)
-		}
-		icons[i] = icon{
-			Base64:  icons[i].Base64,
-			Decoded: img,
-		}
-	}
-
-	return icons[i].Decoded, nil
-}
-
-func setBg() {
-	bg := lastBg.getBg()
-	if showBg {
-		systray.SetTitle(bg)
-	}
-	currentBg.SetTitle(bg)
+	showBg = show
 	if showBg {
-		currentBg.Hide()
-	}
-	icon := lastBg.getIcon()
-	systray.SetIcon(icon)
-}
-
-func toggleShowCurrent(menuItem *systray.MenuItem, db *bolt.DB) {
-	if menuItem.Checked() {
-		menuItem.Uncheck()
-		currentBg.Show()
-		systray.SetTitle("")
-		showBg = false
+		showCurrent.Check()
+		systray.SetTitle(trayTitle())
 	} else {
-		menuItem.Check()
-		currentBg.Hide()
-		showBg = true
-		systray.SetTitle(lastBg.format())
+		showCurrent.Uncheck()
+		systray.SetTitle("")
+	}
+	for _, p := range profiles {
+		if showBg {
+			p.menu.currentBg.Hide()
+		} else {
+			p.menu.currentBg.Show()
+		}
 	}
 	db.Update(func(tx *bolt.Tx) error {
 		v := "false"
-		if menuItem.Checked() {
+		if showBg {
 			v = "true"
 		}
 		b := tx.Bucket([]byte("keys"))
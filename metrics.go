@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var (
+	fetchBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// directionCodes gives each direction a number for graphing, positive
+	// when rising and negative when falling.
+	directionCodes = map[string]float64{
+		"⤊": 4,
+		"⇈": 3,
+		"↑": 2,
+		"↗": 1,
+		"→": 0,
+		"↘": -1,
+		"↓": -2,
+		"⇊": -3,
+		"⤋": -4,
+	}
+)
+
+// profileMetrics are updated as a profile is refreshed so scrapes never reach
+// the data source.
+type profileMetrics struct {
+	alerts        map[string]float64
+	delta         float64
+	fetches       float64
+	fetchErrors   float64
+	fetchBuckets  []float64
+	fetchCount    float64
+	fetchDuration float64
+}
+
+func newProfileMetrics() profileMetrics {
+	return profileMetrics{
+		alerts:       map[string]float64{},
+		fetchBuckets: make([]float64, len(fetchBuckets)),
+	}
+}
+
+func (m *profileMetrics) observeFetch(duration time.Duration, err error) {
+	m.fetches++
+	if err != nil {
+		m.fetchErrors++
+	}
+	seconds := duration.Seconds()
+	for i, le := range fetchBuckets {
+		if seconds <= le {
+			m.fetchBuckets[i]++
+		}
+	}
+	m.fetchCount++
+	m.fetchDuration += seconds
+}
+
+// serveMetrics runs a server with only the Prometheus endpoint, which unlike
+// the HTTP API may listen on any address so a remote Prometheus can scrape it.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	logError("Stopped serving metrics", "addr", addr, "err", http.ListenAndServe(addr, mux))
+}
+
+// writeMetrics renders the metrics before writing them, so a slow client
+// doesn't hold up the readings.
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	setBgMutex.Lock()
+	renderMetrics(&buf)
+	setBgMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func renderMetrics(w io.Writer) {
+	gauge := func(name string, help string, value func(p *profile) (float64, bool)) {
+		metricHeader(w, name, help, "gauge")
+		for _, p := range profiles {
+			if v, ok := value(p); ok {
+				fmt.Fprintf(w, "%s{profile=%q} %g\n", name, p.Name, v)
+			}
+		}
+	}
+	counter := func(name string, help string, value func(p *profile) float64) {
+		metricHeader(w, name, help, "counter")
+		for _, p := range profiles {
+			fmt.Fprintf(w, "%s{profile=%q} %g\n", name, p.Name, value(p))
+		}
+	}
+	hasReading := func(p *profile) bool {
+		return p.bg.Value.Timestamp > 0
+	}
+
+	gauge("cgm_glucose_mmol", "Latest glucose reading in mmol/L.", func(p *profile) (float64, bool) {
+		return round(p.bg.Value.Value, 2), hasReading(p)
+	})
+	gauge("cgm_glucose_mgdl", "Latest glucose reading in mg/dL.", func(p *profile) (float64, bool) {
+		return math.Round(p.bg.Value.Value * mgdltommol), hasReading(p)
+	})
+	gauge("cgm_glucose_delta_mmol", "Change in mmol/L since the previous reading.", func(p *profile) (float64, bool) {
+		return round(p.metrics.delta, 2), hasReading(p)
+	})
+	gauge("cgm_direction", "Trend arrow, from -4 (triple down) to 4 (triple up).", func(p *profile) (float64, bool) {
+		code, ok := directionCodes[p.bg.Direction.Value]
+		return code, ok && hasReading(p)
+	})
+	gauge("cgm_reading_timestamp_seconds", "Time of the latest reading.", func(p *profile) (float64, bool) {
+		return float64(p.bg.Value.Timestamp) / 1000, hasReading(p)
+	})
+	gauge("cgm_reading_age_seconds", "Seconds since the latest reading was taken.", func(p *profile) (float64, bool) {
+		return math.Round(p.age().Seconds()), hasReading(p)
+	})
+	gauge("cgm_iob_units", "Insulin on board reported by nightscout.", func(p *profile) (float64, bool) {
+		if p.onBoard.IOB == nil {
+			return 0, false
+		}
+		return *p.onBoard.IOB, true
+	})
+	gauge("cgm_cob_grams", "Carbs on board reported by nightscout.", func(p *profile) (float64, bool) {
+		if p.onBoard.COB == nil {
+			return 0, false
+		}
+		return *p.onBoard.COB, true
+	})
+	counter("cgm_fetches_total", "Readings fetched from the data source.", func(p *profile) float64 {
+		return p.metrics.fetches
+	})
+	counter("cgm_fetch_errors_total", "Failed fetches from the data source.", func(p *profile) float64 {
+		return p.metrics.fetchErrors
+	})
+
+	metricHeader(w, "cgm_fetch_duration_seconds", "Time taken to fetch a reading.", "histogram")
+	for _, p := range profiles {
+		for i, le := range fetchBuckets {
+			fmt.Fprintf(w, "cgm_fetch_duration_seconds_bucket{profile=%q,le=\"%g\"} %g\n", p.Name, le, p.metrics.fetchBuckets[i])
+		}
+		fmt.Fprintf(w, "cgm_fetch_duration_seconds_bucket{profile=%q,le=\"+Inf\"} %g\n", p.Name, p.metrics.fetchCount)
+		fmt.Fprintf(w, "cgm_fetch_duration_seconds_sum{profile=%q} %g\n", p.Name, p.metrics.fetchDuration)
+		fmt.Fprintf(w, "cgm_fetch_duration_seconds_count{profile=%q} %g\n", p.Name, p.metrics.fetchCount)
+	}
+
+	metricHeader(w, "cgm_alerts_total", "Alerts raised by type.", "counter")
+	for _, p := range profiles {
+		types := make([]string, 0, len(p.metrics.alerts))
+		for t := range p.metrics.alerts {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "cgm_alerts_total{profile=%q,type=%q} %g\n", p.Name, t, p.metrics.alerts[t])
+		}
+	}
+}
+
+func metricHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func round(v float64, places int) float64 {
+	shift := math.Pow(10, float64(places))
+	return math.Round(v*shift) / shift
+}
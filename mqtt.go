@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttTimeout = 10 * time.Second
+
+// mqttConfig is the mqtt section of the config file. The broker may also be
+// given with the -mqtt flag.
+type mqttConfig struct {
+	Broker          string `json:"broker"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ClientId        string `json:"clientId"`
+	Topic           string `json:"topic"`
+	DiscoveryPrefix string `json:"discoveryPrefix"`
+}
+
+type mqttState struct {
+	Value     float64 `json:"value"`
+	Mgdl      int     `json:"mgdl"`
+	Direction string  `json:"direction"`
+	Timestamp int64   `json:"timestamp"`
+	Range     string  `json:"range"`
+	Title     string  `json:"title"`
+}
+
+// mqttPublisher publishes each profile's reading as a retained message on
+// <topic>/<profile>/state and alerts on <topic>/<profile>/alert, along with
+// Home Assistant discovery config so the sensors appear without any YAML.
+type mqttPublisher struct {
+	client mqtt.Client
+	config mqttConfig
+}
+
+var mqttSettings mqttConfig
+
+func startMqtt() {
+	c := mqttSettings
+	if *args.MqttBroker != "" {
+		c.Broker = *args.MqttBroker
+	}
+	m := newMqttPublisher(c)
+	// With ConnectRetry the client keeps trying in the background, so the
+	// token only completes once the broker is reachable.
+	m.client.Connect()
+
+	readingHooks = append(readingHooks, m.publishState)
+	notifiers = append(notifiers, &routedNotifier{notifier: m})
+}
+
+// newMqttPublisher fills in the config's defaults and sets up a client for
+// it, without connecting.
+func newMqttPublisher(c mqttConfig) *mqttPublisher {
+	if c.Topic == "" {
+		c.Topic = "cgm"
+	}
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	if c.ClientId == "" {
+		host, _ := os.Hostname()
+		c.ClientId = "cgm-" + host
+	}
+
+	m := &mqttPublisher{config: c}
+	options := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientId).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(m.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(m.connected).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			logWarn("Lost connection to the MQTT broker", "err", err)
+		})
+	m.client = mqtt.NewClient(options)
+	return m
+}
+
+func (m *mqttPublisher) availabilityTopic() string {
+	return m.config.Topic + "/status"
+}
+
+func (m *mqttPublisher) profileTopic(name string) string {
+	return m.config.Topic + "/" + mqttSlug(name)
+}
+
+// mqttSlugInvalid matches what can't go in a topic level or a Home Assistant
+// id, which allows lower case letters, digits, underscores and hyphens.
+var mqttSlugInvalid = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// mqttSlug turns a profile name into something safe for topics and Home
+// Assistant ids.
+func mqttSlug(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return mqttSlugInvalid.ReplaceAllString(strings.ToLower(name), "_")
+}
+
+// connected announces the sensors and republishes the current state, since
+// the broker may have been restarted without persistence.
+func (m *mqttPublisher) connected(client mqtt.Client) {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
+
+	m.publish(m.availabilityTopic(), true, "online")
+	for _, p := range profiles {
+		m.publishDiscovery(p)
+		if p.bg.Value.Timestamp > 0 {
+			m.publishState(p)
+		}
+	}
+}
+
+func (m *mqttPublisher) publishState(p *profile) {
+	m.publish(m.profileTopic(p.Name)+"/state", true, mqttState{
+		Value:     round(p.bg.Value.Value, 1),
+		Mgdl:      int(math.Round(p.bg.Value.Value * mgdltommol)),
+		Direction: p.bg.Direction.Value,
+		Timestamp: p.bg.Value.Timestamp,
+		Range:     p.rangeState(),
+		Title:     p.title(),
+	})
+}
+
+// notify publishes alerts without retaining them so automations only fire
+// when they happen.
+func (m *mqttPublisher) notify(n notification) error {
+	m.publish(m.profileTopic(n.Profile)+"/alert", false, n)
+	return nil
+}
+
+func (m *mqttPublisher) publishDiscovery(p *profile) {
+	slug := mqttSlug(p.Name)
+	name := "CGM"
+	if p.Name != "" {
+		name = "CGM " + p.Name
+	}
+	device := map[string]interface{}{
+		"identifiers":  []string{"cgm_" + slug},
+		"name":         name,
+		"manufacturer": "nightscout-go-systray",
+	}
+	sensors := []struct {
+		component string
+		id        string
+		config    map[string]interface{}
+	}{
+		{"sensor", "bg", map[string]interface{}{
+			"name":                "Blood glucose",
+			"unit_of_measurement": "mmol/L",
+			"value_template":      "{{ value_json.value }}",
+			"state_class":         "measurement",
+			"icon":                "mdi:diabetes",
+		}},
+		{"sensor", "direction", map[string]interface{}{
+			"name":           "Direction",
+			"value_template": "{{ value_json.direction }}",
+		}},
+		{"sensor", "range", map[string]interface{}{
+			"name":           "Range",
+			"value_template": "{{ value_json.range }}",
+		}},
+		{"binary_sensor", "low", map[string]interface{}{
+			"name":           "Low",
+			"value_template": "{{ 'ON' if value_json.range == 'low' else 'OFF' }}",
+			"device_class":   "problem",
+		}},
+	}
+	for _, s := range sensors {
+		s.config["unique_id"] = fmt.Sprintf("cgm_%s_%s", slug, s.id)
+		s.config["state_topic"] = m.profileTopic(p.Name) + "/state"
+		s.config["availability_topic"] = m.availabilityTopic()
+		s.config["device"] = device
+		topic := fmt.Sprintf("%s/%s/cgm_%s/%s/config", m.config.DiscoveryPrefix, s.component, slug, s.id)
+		m.publish(topic, true, s.config)
+	}
+}
+
+// publish sends the payload, encoding it as JSON unless it's already a
+// string, and logs failures without holding up the caller.
+func (m *mqttPublisher) publish(topic string, retained bool, payload interface{}) {
+	data, ok := payload.(string)
+	if !ok {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			logError("Failed to encode MQTT payload", "topic", topic, "err", err)
+			return
+		}
+		data = string(encoded)
+	}
+	token := m.client.Publish(topic, 1, retained, data)
+	go func() {
+		if !token.WaitTimeout(mqttTimeout) {
+			logWarn("Timed out publishing to MQTT", "topic", topic)
+		} else if err := token.Error(); err != nil {
+			logWarn("Failed to publish to MQTT", "topic", topic, "err", err)
+		}
+	}()
+}
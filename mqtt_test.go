@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMqttClient records what's published instead of sending it to a broker.
+type fakeMqttClient struct {
+	mqtt.Client
+	mutex    sync.Mutex
+	messages map[string]fakeMqttMessage
+}
+
+type fakeMqttMessage struct {
+	payload  string
+	retained bool
+}
+
+func (c *fakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messages[topic] = fakeMqttMessage{payload.(string), retained}
+	return doneToken{}
+}
+
+func (c *fakeMqttClient) message(t *testing.T, topic string) fakeMqttMessage {
+	t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	m, ok := c.messages[topic]
+	if !ok {
+		t.Fatalf("Nothing published to %s", topic)
+	}
+	return m
+}
+
+// doneToken is a token for a publish that has already completed.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func newMqttTestProfile(t *testing.T) *profile {
+	p := &profile{
+		Name:       "Sam Smith",
+		Url:        "http://localhost",
+		thresholds: thresholds{Urgenthigh: 15, High: 8, Low: 4},
+		Templates:  defaultTemplates(),
+	}
+	if err := p.setup(); err != nil {
+		t.Fatal(err)
+	}
+	p.bg.Value = bgValue{Timestamp: 1700000000000, Value: 3.5}
+	p.bg.Direction = directions["SingleDown"]
+	return p
+}
+
+func newFakeMqttPublisher() (*mqttPublisher, *fakeMqttClient) {
+	m := newMqttPublisher(mqttConfig{Broker: "tcp://localhost:1883"})
+	client := &fakeMqttClient{messages: map[string]fakeMqttMessage{}}
+	m.client = client
+	return m, client
+}
+
+func TestMqttSlug(t *testing.T) {
+	tests := map[string]string{
+		"":           "default",
+		"Sam":        "sam",
+		"Sam Smith":  "sam_smith",
+		"a/b+c#d":    "a_b_c_d",
+		"José":       "jos_",
+		"kid-2_home": "kid-2_home",
+	}
+	for name, want := range tests {
+		if got := mqttSlug(name); got != want {
+			t.Errorf("mqttSlug(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMqttState(t *testing.T) {
+	m, client := newFakeMqttPublisher()
+	p := newMqttTestProfile(t)
+	m.publishState(p)
+
+	msg := client.message(t, "cgm/sam_smith/state")
+	if !msg.retained {
+		t.Error("Expected the state to be retained")
+	}
+	var state mqttState
+	if err := json.Unmarshal([]byte(msg.payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	want := mqttState{Value: 3.5, Mgdl: 63, Direction: "↓", Timestamp: 1700000000000, Range: "low", Title: p.title()}
+	if state != want {
+		t.Errorf("State = %+v, want %+v", state, want)
+	}
+}
+
+func TestMqttDiscovery(t *testing.T) {
+	m, client := newFakeMqttPublisher()
+	p := newMqttTestProfile(t)
+	m.publishDiscovery(p)
+
+	msg := client.message(t, "homeassistant/sensor/cgm_sam_smith/bg/config")
+	if !msg.retained {
+		t.Error("Expected the discovery config to be retained")
+	}
+	var config struct {
+		UniqueId          string `json:"unique_id"`
+		StateTopic        string `json:"state_topic"`
+		AvailabilityTopic string `json:"availability_topic"`
+		Unit              string `json:"unit_of_measurement"`
+		Device            struct {
+			Identifiers []string `json:"identifiers"`
+			Name        string   `json:"name"`
+		} `json:"device"`
+	}
+	if err := json.Unmarshal([]byte(msg.payload), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.UniqueId != "cgm_sam_smith_bg" || config.StateTopic != "cgm/sam_smith/state" || config.AvailabilityTopic != "cgm/status" || config.Unit != "mmol/L" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if len(config.Device.Identifiers) != 1 || config.Device.Identifiers[0] != "cgm_sam_smith" || config.Device.Name != "CGM Sam Smith" {
+		t.Errorf("Unexpected device %+v", config.Device)
+	}
+	for _, topic := range []string{
+		"homeassistant/sensor/cgm_sam_smith/direction/config",
+		"homeassistant/sensor/cgm_sam_smith/range/config",
+		"homeassistant/binary_sensor/cgm_sam_smith/low/config",
+	} {
+		client.message(t, topic)
+	}
+}
+
+func TestMqttAlert(t *testing.T) {
+	m, client := newFakeMqttPublisher()
+	n := notification{Profile: "Sam Smith", Type: "Low", Message: "Low!", Value: 3.5, Mgdl: 63, Direction: "↓", Timestamp: 1700000000000}
+	if err := m.notify(n); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := client.message(t, "cgm/sam_smith/alert")
+	if msg.retained {
+		t.Error("Expected the alert not to be retained")
+	}
+	var got notification
+	if err := json.Unmarshal([]byte(msg.payload), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != n {
+		t.Errorf("Alert = %+v, want %+v", got, n)
+	}
+}
+
+// TestMqttBroker publishes to a real broker, such as a local mosquitto, when
+// CGM_MQTT_BROKER is set, e.g. CGM_MQTT_BROKER=tcp://localhost:1883.
+func TestMqttBroker(t *testing.T) {
+	broker := os.Getenv("CGM_MQTT_BROKER")
+	if broker == "" {
+		t.Skip("CGM_MQTT_BROKER isn't set")
+	}
+	topic := "cgm-test-" + time.Now().Format("150405.000")
+	m := newMqttPublisher(mqttConfig{Broker: broker, Topic: topic, ClientId: topic})
+	p := newMqttTestProfile(t)
+	profiles = []*profile{p}
+	if token := m.client.Connect(); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+		t.Fatalf("Failed to connect to %s: %v", broker, token.Error())
+	}
+	defer m.client.Disconnect(0)
+
+	// The state is retained, so a client subscribing afterwards still gets it.
+	m.publishState(p)
+	received := make(chan mqtt.Message, 10)
+	sub := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(topic + "-sub"))
+	if token := sub.Connect(); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+		t.Fatalf("Failed to connect to %s: %v", broker, token.Error())
+	}
+	defer sub.Disconnect(0)
+	token := sub.Subscribe(topic+"/#", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	})
+	if !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe: %v", token.Error())
+	}
+	m.notify(notification{Profile: p.Name, Type: "Low", Message: "Low!"})
+
+	want := map[string]bool{topic + "/sam_smith/state": true, topic + "/sam_smith/alert": true}
+	timeout := time.After(mqttTimeout)
+	for len(want) > 0 {
+		select {
+		case msg := <-received:
+			delete(want, msg.Topic())
+		case <-timeout:
+			t.Fatalf("Never received %v", want)
+		}
+	}
+	// Clear the retained messages left on the broker.
+	for _, retained := range []string{topic + "/status", topic + "/sam_smith/state"} {
+		m.client.Publish(retained, 1, true, "").WaitTimeout(mqttTimeout)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// notifier delivers alerts somewhere other than the desktop.
+type notifier interface {
+	notify(n notification) error
+}
+
+// notifierConfig is a notifier in the config file. Alerts lists the alert
+// types it receives, all of them when empty, and failed deliveries are
+// retried Retries times with increasing delays.
+type notifierConfig struct {
+	Type     string            `json:"type"`
+	Command  string            `json:"command"`
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Template string            `json:"template"`
+	Alerts   []string          `json:"alerts"`
+	Retries  int               `json:"retries"`
+}
+
+// notification is what notifiers are given, as environment variables for
+// commands and as the JSON payload or template data for webhooks.
+type notification struct {
+	Profile   string  `json:"profile"`
+	Type      string  `json:"type"`
+	Message   string  `json:"message"`
+	Value     float64 `json:"value"`
+	Mgdl      int     `json:"mgdl"`
+	Direction string  `json:"direction"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+type routedNotifier struct {
+	notifier
+	alerts  map[string]bool
+	retries int
+}
+
+type commandNotifier struct {
+	command string
+}
+
+type webhookNotifier struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+var notifiers []*routedNotifier
+
+func (c notifierConfig) notifier() (*routedNotifier, error) {
+	r := &routedNotifier{
+		alerts:  map[string]bool{},
+		retries: c.Retries,
+	}
+	for _, a := range c.Alerts {
+		if !isAlertType(a) && !isRateAlert(a) {
+			return nil, fmt.Errorf("Unknown alert type %q", a)
+		}
+		r.alerts[a] = true
+	}
+
+	switch c.Type {
+	case "command":
+		if c.Command == "" {
+			return nil, fmt.Errorf("A command is required")
+		}
+		r.notifier = &commandNotifier{command: c.Command}
+	case "webhook":
+		if c.Url == "" {
+			return nil, fmt.Errorf("A webhook url is required")
+		}
+		w := &webhookNotifier{
+			url:     c.Url,
+			headers: c.Headers,
+		}
+		if c.Template != "" {
+			var err error
+			if w.template, err = template.New("webhook").Parse(c.Template); err != nil {
+				return nil, err
+			}
+		}
+		r.notifier = w
+	default:
+		return nil, fmt.Errorf("Unknown notifier type %q, expected command or webhook", c.Type)
+	}
+
+	return r, nil
+}
+
+// isRateAlert is true when any profile has a rate alert named t.
+func isRateAlert(t string) bool {
+	for _, p := range profiles {
+		for _, r := range p.RateAlerts {
+			if r.Name == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isAlertType(t string) bool {
+	if t == "Direction failed" {
+		return true
+	}
+	for _, k := range alertKeys {
+		if k == t {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAll sends the alert to every notifier routed to receive its type,
+// retrying in the background so slow endpoints don't hold up the tray.
+func (p *profile) notifyAll(a alert) {
+	n := notification{
+		Profile:   p.Name,
+		Type:      a.Type,
+		Message:   p.label(a.Message),
+		Value:     round(p.bg.Value.Value, 1),
+		Mgdl:      int(math.Round(p.bg.Value.Value * mgdltommol)),
+		Direction: p.bg.Direction.Value,
+		Timestamp: p.bg.Value.Timestamp,
+	}
+	for _, r := range notifiers {
+		if len(r.alerts) > 0 && !r.alerts[a.Type] {
+			continue
+		}
+		go r.deliver(n)
+	}
+}
+
+func (r *routedNotifier) deliver(n notification) {
+	for attempt := 0; ; attempt++ {
+		err := r.notify(n)
+		if err == nil {
+			return
+		}
+		if attempt >= r.retries {
+			logError("Failed to deliver alert", "profile", n.Profile, "type", n.Type, "attempts", attempt+1, "err", err)
+			return
+		}
+		time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+	}
+}
+
+// notify runs the command with sh, passing the alert in CGM_* environment
+// variables.
+func (c *commandNotifier) notify(n notification) error {
+	cmd := exec.Command("sh", "-c", c.command)
+	cmd.Env = append(os.Environ(),
+		"CGM_PROFILE="+n.Profile,
+		"CGM_ALERT="+n.Type,
+		"CGM_MESSAGE="+n.Message,
+		"CGM_BG="+strconv.FormatFloat(n.Value, 'f', 1, 64),
+		"CGM_MGDL="+strconv.Itoa(n.Mgdl),
+		"CGM_DIRECTION="+n.Direction,
+		"CGM_TIMESTAMP="+strconv.FormatInt(n.Timestamp, 10),
+	)
+	timer := time.AfterFunc(notifyTimeout, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// notify POSTs the notification as JSON, or the rendered template when one is
+// configured so services with their own payloads can be used.
+func (w *webhookNotifier) notify(n notification) error {
+	var body bytes.Buffer
+	contentType := "application/json"
+	if w.template != nil {
+		if err := w.template.Execute(&body, n); err != nil {
+			return err
+		}
+		if !json.Valid(body.Bytes()) {
+			contentType = "text/plain; charset=utf-8"
+		}
+	} else if err := json.NewEncoder(&body).Encode(n); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", w.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
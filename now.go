@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	nowInRange = iota
+	nowHigh
+	nowLow
+	nowStale
+	nowError
+)
+
+var nowColours = map[string]string{
+	"green":  "\033[32m",
+	"orange": "\033[33m",
+	"red":    "\033[31m",
+}
+
+type nowOutput struct {
+	Name       string   `json:"name,omitempty"`
+	Value      float64  `json:"value"`
+	Mgdl       int      `json:"mgdl"`
+	Direction  string   `json:"direction"`
+	Delta      *float64 `json:"delta"`
+	Timestamp  int64    `json:"timestamp"`
+	AgeSeconds int      `json:"ageSeconds"`
+	Range      string   `json:"range"`
+	Stale      bool     `json:"stale"`
+}
+
+// runNow prints the latest reading once and exits with a status reflecting
+// its range, for shell prompts and scripts.
+func runNow(arguments []string) {
+	logToStderr()
+	nowFlags := flag.NewFlagSet("now", flag.ExitOnError)
+	asJson := nowFlags.Bool("json", false, "Print the reading as JSON")
+	name := nowFlags.String("profile", "", "Name of the profile to show (default the first profile)")
+	nowFlags.Parse(arguments)
+
+	p := profiles[0]
+	if *name != "" {
+		p = findProfile(*name)
+		if p == nil {
+			logError(fmt.Sprintf("No profile named %q", *name))
+			os.Exit(nowError)
+		}
+	}
+
+	// Without a reading there's nothing recent to show, which is reported
+	// the same as a stale one.
+	r, err := p.source.latest()
+	if err != nil {
+		logError("Failed to fetch the latest reading", "profile", p.logName(), "err", err)
+		os.Exit(nowStale)
+	}
+	if s, ok := p.source.(clockSource); ok {
+		p.checkClock(s)
+	}
+	// The previous reading is only needed for the delta, so failing to get
+	// it isn't fatal.
+	since := time.Unix(0, r.Timestamp*int64(time.Millisecond)).Add(-3 * p.source.interval())
+	history, err := p.source.history(since)
+	if err != nil {
+		logWarn("Failed to fetch the previous reading", "profile", p.logName(), "err", err)
+	}
+	var previous reading
+	for _, h := range history {
+		if h.Timestamp < r.Timestamp && h.Timestamp > previous.Timestamp {
+			previous = h
+		}
+	}
+	if previous.Timestamp > 0 {
+		p.setReading(previous)
+	}
+	p.setReading(r)
+
+	o := nowOutput{
+		Name:       p.Name,
+		Value:      round(p.bg.Value.Value, 1),
+		Mgdl:       r.Mgdl,
+		Direction:  p.bg.Direction.Value,
+		Timestamp:  p.bg.Value.Timestamp,
+		AgeSeconds: int(p.age().Seconds()),
+		Range:      p.rangeState(),
+		Stale:      p.isStale(),
+	}
+	if delta, ok := p.bg.delta(); ok {
+		delta = round(delta, 1)
+		o.Delta = &delta
+	}
+
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(o)
+	} else {
+		line := nowLine(p)
+		if colour := nowColours[p.getIcon()]; colour != "" && useColour() {
+			line = colour + line + "\033[0m"
+		}
+		fmt.Println(line)
+	}
+
+	switch {
+	case o.Stale:
+		os.Exit(nowStale)
+	case p.isLow(p.bg.Value):
+		os.Exit(nowLow)
+	case p.isHigh(p.bg.Value):
+		os.Exit(nowHigh)
+	}
+	os.Exit(nowInRange)
+}
+
+// nowLine is the reading as e.g. `7.2 → (+0.3) 2 min ago`. It doesn't use
+// the title template, so scripts reading it aren't affected when the tray's
+// title is customised.
+func nowLine(p *profile) string {
+	d := p.templateData()
+	line := d.Value + " " + d.Arrow
+	if d.Delta != "" {
+		line += " (" + d.Delta + ")"
+	}
+	return line + " " + tr("%s ago", d.Age)
+}
+
+// useColour is true when stdout is a terminal and NO_COLOR isn't set.
+func useColour() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const pollMargin = 15 * time.Second
+const pollMaxBackoff = 10 * time.Minute
+const pollMinRetry = 10 * time.Second
+const pollWake = time.Minute
+
+// poll refreshes each profile when its next reading should have arrived, and
+// whenever a pushing source announces one. It wakes at least every pollWake so
+// profiles whose socket dropped are picked up again.
+func poll(db *bolt.DB, updates <-chan *profile) {
+	for {
+		next := time.Now().Add(pollWake)
+		for _, p := range polledProfiles() {
+			if p.pollAt.Before(next) {
+				next = p.pollAt
+			}
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			checkPushed(db)
+			var due []*profile
+			now := time.Now()
+			for _, p := range polledProfiles() {
+				if !p.pollAt.After(now) {
+					due = append(due, p)
+				}
+			}
+			if len(due) > 0 {
+				setBg(db, due...)
+			} else {
+				// Nothing to fetch, but the age in the title has moved on.
+				setBgMutex.Lock()
+				render()
+				setBgMutex.Unlock()
+			}
+		case p := <-updates:
+			timer.Stop()
+			setBg(db, p)
+		}
+	}
+}
+
+// checkPushed raises stale data and loop failure alerts for profiles fed by a
+// socket. They're only refreshed when an update arrives, so they would never
+// notice the updates stopping.
+func checkPushed(db *bolt.DB) {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
+
+	for _, p := range profiles {
+		if s, ok := p.source.(pusher); ok && s.connected() {
+			p.raise(db, p.getStatusAlerts())
+		}
+	}
+}
+
+// schedule works out when to next fetch the profile. Normally that's when the
+// source's next reading is due plus a small margin; if that reading is late it
+// retries quickly, and during long gaps or repeated errors it backs off.
+func (p *profile) schedule(err error) {
+	now := time.Now()
+	interval := p.source.interval()
+	retry := interval / 10
+	if retry < pollMinRetry {
+		retry = pollMinRetry
+	}
+
+	if err != nil || p.bg.Value.Timestamp == 0 {
+		p.pollFailures++
+		wait := retry << uint(p.pollFailures-1)
+		if wait > pollMaxBackoff || wait <= 0 {
+			wait = pollMaxBackoff
+		}
+		p.pollAt = now.Add(wait)
+		logDebug("Fetch failed, retrying", "profile", p.logName(), "failures", p.pollFailures, "at", p.pollAt.Format("15:04:05"))
+		return
+	}
+	p.pollFailures = 0
+
+	due := p.readingTime(p.bg.Value.Timestamp).Add(interval + pollMargin)
+	late := now.Sub(due)
+	switch {
+	case late < 0:
+		p.pollAt = due
+		logDebug("Next reading due", "profile", p.logName(), "at", p.pollAt.Format("15:04:05"))
+	case late < interval:
+		p.pollAt = now.Add(retry)
+		logDebug("Reading late, retrying", "profile", p.logName(), "late", late.Round(time.Second), "at", p.pollAt.Format("15:04:05"))
+	default:
+		wait := late / 3
+		if wait > pollMaxBackoff {
+			wait = pollMaxBackoff
+		}
+		p.pollAt = now.Add(wait)
+		logDebug("No reading, backing off", "profile", p.logName(), "late", late.Round(time.Second), "until", p.pollAt.Format("15:04:05"))
+	}
+}
+
+func (p *profile) logName() string {
+	if p.Name == "" {
+		return "cgm"
+	}
+	return p.Name
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loopFailure is how long the loop can go without running before it counts
+// as failed, three missed five minute cycles.
+const loopFailure = 15 * time.Minute
+
+// optionalAlerts are off unless the profile's preset turns every alert on,
+// since most people following their own readings know when they stopped
+// uploading.
+var optionalAlerts = map[string]bool{
+	"Stale data":   true,
+	"Loop failure": true,
+}
+
+// preset is a set of alert defaults chosen by name, so someone following a
+// child gets stricter behaviour without setting each option. Settings made
+// explicitly, in the config, with flags or in the alerts menu, still win.
+type preset struct {
+	// allAlerts defaults every alert to on, including optionalAlerts.
+	allAlerts bool
+	// repeat raises low and urgent high alerts again this often while they
+	// last.
+	repeat time.Duration
+	// thresholds replace the default thresholds where they're not zero.
+	thresholds thresholds
+	// lastTreatment shows how long ago the last treatment was logged.
+	lastTreatment bool
+}
+
+var presets = map[string]preset{
+	"": {},
+	"caregiver": {
+		allAlerts:     true,
+		repeat:        15 * time.Minute,
+		thresholds:    thresholds{Urgenthigh: 13, Low: 4.5},
+		lastTreatment: true,
+	},
+}
+
+func presetNames() string {
+	var names []string
+	for name := range presets {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyPreset looks up the profile's preset and fills in any thresholds that
+// weren't set explicitly from the preset, then the defaults.
+func (p *profile) applyPreset(defaults thresholds, explicit map[string]bool) error {
+	pr, ok := presets[p.Preset]
+	if !ok {
+		return fmt.Errorf("Unknown preset %q, expected one of %s", p.Preset, presetNames())
+	}
+	p.preset = pr
+	fill := func(value *float64, name string, preset float64, fallback float64) {
+		if *value != 0 {
+			return
+		}
+		if preset != 0 && !explicit[name] {
+			*value = preset
+		} else {
+			*value = fallback
+		}
+	}
+	fill(&p.Urgenthigh, "urgent-high", pr.thresholds.Urgenthigh, defaults.Urgenthigh)
+	fill(&p.High, "high", pr.thresholds.High, defaults.High)
+	fill(&p.Low, "low", pr.thresholds.Low, defaults.Low)
+	return nil
+}
+
+// explicitFlags are the flags given on the command line rather than left at
+// their defaults.
+func explicitFlags() map[string]bool {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// alertDefault is whether an alert is on before it's been toggled in the
+// menu.
+func (p *profile) alertDefault(alert string) bool {
+	return p.preset.allAlerts || !optionalAlerts[alert]
+}
+
+// repeatDue is true when the low or urgent high alert raised earlier should
+// be raised again.
+func (p *profile) repeatDue() bool {
+	if p.preset.repeat == 0 || p.bg.LastBgAlertTime == 0 {
+		return false
+	}
+	return time.Since(time.Unix(p.bg.LastBgAlertTime, 0)) >= p.preset.repeat
+}
+
+// getStatusAlerts raises an alert once when the readings stop arriving and
+// once when the loop stops running, each again after it recovers.
+func (p *profile) getStatusAlerts() (alerts []alert) {
+	b := &p.bg
+	if p.isStale() {
+		if !b.StaleAlerted && p.alertValues["Stale data"] {
+			alerts = append(alerts, alert{"Stale data", tr("No readings for %s", formatAge(p.age()))})
+			b.StaleAlerted = true
+		}
+	} else {
+		b.StaleAlerted = false
+	}
+	if p.onBoard.LastLoop != nil && p.now().Sub(*p.onBoard.LastLoop) > loopFailure {
+		if !b.LoopAlerted && p.alertValues["Loop failure"] {
+			alerts = append(alerts, alert{"Loop failure", tr("Loop hasn't run for %s", formatAge(p.now().Sub(*p.onBoard.LastLoop)))})
+			b.LoopAlerted = true
+		}
+	} else {
+		b.LoopAlerted = false
+	}
+	return
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/getlantern/systray"
+)
+
+type profile struct {
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	Url       string `json:"url"`
+	Token     string `json:"token"`
+	ApiSecret string `json:"apiSecret"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Region    string `json:"region"`
+	Server    string `json:"server"`
+	Patient   string `json:"patient"`
+	Person    string `json:"person"`
+	Preset    string `json:"preset"`
+	thresholds
+	Carbs                int           `json:"carbs"`
+	DelayCompressionLows bool          `json:"delayCompressionLows"`
+	RateAlerts           []rateRule    `json:"rateAlerts"`
+	ServerThresholds     bool          `json:"serverThresholds"`
+	Templates            textTemplates `json:"templates"`
+
+	alertValues    map[string]bool
+	bg             bg
+	cached         bool
+	clockCheckedAt time.Time
+	clockOffset    time.Duration
+	fetchErr       error
+	fetchLatency   time.Duration
+	inRangeTime    time.Time
+	lastTreatment  time.Time
+	// localThresholds are the thresholds from the flags or config, kept
+	// while the server's are in use.
+	localThresholds thresholds
+	lowDelayedAt    int64
+	lowTime         time.Time
+	menu            profileMenu
+	metrics         profileMetrics
+	onBoard         onBoard
+	pollAt          time.Time
+	pollFailures    int
+	preset          preset
+	previousArrow   string
+	recent          []bgValue
+	siteStatus      *siteStatus
+	source          source
+	suspect         string
+	suspectAt       int64
+	templates       parsedTemplates
+}
+
+// alert is a notification to raise, with Type naming the alert setting (or
+// "Direction failed") that produced it.
+type alert struct {
+	Type    string
+	Message string
+}
+
+type profileMenu struct {
+	parent     *systray.MenuItem
+	currentBg  *systray.MenuItem
+	inRangeAt  *systray.MenuItem
+	lowAt      *systray.MenuItem
+	previousBg *systray.MenuItem
+	rate       *systray.MenuItem
+	clockSkew  *systray.MenuItem
+	suspect    *systray.MenuItem
+	treatment  *systray.MenuItem
+	server     serverMenu
+	// alertHistory are the alert history entries, newest first.
+	alertHistory []*systray.MenuItem
+	noAlerts     *systray.MenuItem
+}
+
+type thresholds struct {
+	Urgenthigh float64 `json:"urgentHigh"`
+	High       float64 `json:"high"`
+	Low        float64 `json:"low"`
+}
+
+// setup initialises the unexported state of a profile read from flags or
+// config.
+func (p *profile) setup() (err error) {
+	p.Url = strings.TrimRight(p.Url, "/")
+	p.localThresholds = p.thresholds
+	p.alertValues = map[string]bool{}
+	p.metrics = newProfileMetrics()
+	if p.templates, err = p.Templates.parse(); err != nil {
+		return
+	}
+	names := map[string]bool{}
+	for i := range p.RateAlerts {
+		r := &p.RateAlerts[i]
+		if err = r.validate(); err != nil {
+			return
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Rate alert %q is defined twice", r.Name)
+		}
+		names[r.Name] = true
+	}
+	p.source, err = p.newSource()
+	return
+}
+
+func findProfile(name string) *profile {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (t thresholds) isUrgentHigh(b bgValue) bool {
+	return b.Value >= t.Urgenthigh
+}
+
+func (t thresholds) isHigh(b bgValue) bool {
+	return b.Value >= t.High
+}
+
+func (t thresholds) isLow(b bgValue) bool {
+	return b.Value < t.Low
+}
+
+// bucket namespaces a bolt bucket per profile. The unnamed profile keeps the
+// original bucket names so existing settings carry over.
+func (p *profile) bucket(name string) []byte {
+	if p.Name == "" {
+		return []byte(name)
+	}
+	return []byte(name + ":" + p.Name)
+}
+
+// label prefixes a message with the person's name, or else the profile name,
+// so alerts say who they are about.
+func (p *profile) label(message string) string {
+	name := p.Person
+	if name == "" {
+		name = p.Name
+	}
+	if name == "" {
+		return message
+	}
+	return name + ": " + message
+}
+
+func (p *profile) browserUrl() string {
+	if p.Token == "" {
+		return p.Url
+	}
+	return p.Url + "?token=" + url.QueryEscape(p.Token)
+}
+
+func (p *profile) addMenu(db *bolt.DB, grouped bool) {
+	if grouped {
+		p.menu.parent = systray.AddMenuItem(p.Name, "")
+	}
+	p.menu.currentBg = p.addMenuItem("")
+	if showBg {
+		p.menu.currentBg.Hide()
+	}
+	p.menu.inRangeAt = p.addMenuItem("")
+	p.menu.inRangeAt.Hide()
+	p.menu.lowAt = p.addMenuItem("")
+	p.menu.lowAt.Hide()
+	p.menu.previousBg = p.addMenuItem("")
+	p.menu.previousBg.Hide()
+	p.menu.rate = p.addMenuItem("")
+	p.menu.rate.Hide()
+	p.menu.clockSkew = p.addMenuItem("")
+	p.menu.clockSkew.Hide()
+	p.menu.suspect = p.addMenuItem("")
+	p.menu.suspect.Hide()
+	p.menu.treatment = p.addMenuItem("")
+	p.menu.treatment.Hide()
+	open := p.addMenuItem(tr("Open in browser"))
+	if p.Url == "" {
+		open.Hide()
+	}
+	generateReport := p.addMenuItem(tr("Generate report"))
+	p.addAlertHistoryMenu(db)
+	p.addAlertSettings(db)
+	p.addServerMenu(db)
+	go func() {
+		for {
+			select {
+			case <-open.ClickedCh:
+				exec.Command("xdg-open", p.browserUrl()).Start()
+			case <-generateReport.ClickedCh:
+				openReport(db, p)
+			}
+		}
+	}()
+}
+
+func (p *profile) addMenuItem(title string) *systray.MenuItem {
+	if p.menu.parent == nil {
+		return systray.AddMenuItem(title, "")
+	}
+	return p.menu.parent.AddSubMenuItem(title, "")
+}
+
+// alertTypes are the built in alerts followed by the profile's rate alerts.
+func (p *profile) alertTypes() []string {
+	types := append([]string{}, alertKeys...)
+	for _, r := range p.RateAlerts {
+		types = append(types, r.Name)
+	}
+	return types
+}
+
+func (p *profile) addAlertSettings(db *bolt.DB) {
+	alerts := p.addMenuItem(tr("Alerts"))
+	db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(p.bucket("alerts"))
+		if err != nil {
+			return err
+		}
+		for _, alert := range p.alertTypes() {
+			v := b.Get([]byte(alert))
+			if len(v) == 0 {
+				p.alertValues[alert] = p.alertDefault(alert)
+			} else {
+				p.alertValues[alert] = (string(v) == "true")
+			}
+			a := alerts.AddSubMenuItemCheckbox(tr(alert), "", p.alertValues[alert])
+			go func(alert string) {
+				for {
+					select {
+					case <-a.ClickedCh:
+						setBgMutex.Lock()
+						if a.Checked() {
+							a.Uncheck()
+						} else {
+							a.Check()
+						}
+						on := a.Checked()
+						p.alertValues[alert] = on
+						setBgMutex.Unlock()
+						db.Update(func(tx *bolt.Tx) error {
+							v := "false"
+							if on {
+								v = "true"
+							}
+							b := tx.Bucket(p.bucket("alerts"))
+							return b.Put([]byte(alert), []byte(v))
+						})
+					}
+				}
+			}(alert)
+		}
+		return nil
+	})
+}
+
+// updateMenu reflects the latest reading and predictions in the profile's
+// menu items.
+func (p *profile) updateMenu() {
+	p.updateServerMenu()
+	if p.bg.Value.Timestamp == 0 {
+		return
+	}
+	p.menu.currentBg.SetTitle(p.title())
+	if p.menu.parent != nil {
+		p.menu.parent.SetTitle(p.title())
+	}
+	d := p.templateData()
+	if p.bg.PreviousValue.Timestamp > 0 {
+		p.menu.previousBg.SetTitle(p.execute(p.templates.previous, p.readingData(p.bg.PreviousValue, p.previousArrow)))
+		p.menu.previousBg.Show()
+	}
+	if d.Rate != "" {
+		p.menu.rate.SetTitle(p.execute(p.templates.rate, d))
+		p.menu.rate.Show()
+	} else {
+		p.menu.rate.Hide()
+	}
+	if p.suspect != "" {
+		p.menu.suspect.SetTitle("⚠ " + p.suspectText())
+		p.menu.suspect.Show()
+	} else {
+		p.menu.suspect.Hide()
+	}
+	if !p.lastTreatment.IsZero() {
+		p.menu.treatment.SetTitle(tr("Last treatment %s ago", formatAge(p.now().Sub(p.lastTreatment))))
+		p.menu.treatment.Show()
+	} else {
+		p.menu.treatment.Hide()
+	}
+	if w := p.clockWarning(); w != "" {
+		p.menu.clockSkew.SetTitle(w)
+		p.menu.clockSkew.Show()
+	} else {
+		p.menu.clockSkew.Hide()
+	}
+	if p.lowTime.After(time.Now()) && p.lowTime.Before(time.Now().Add(predictLowSeconds*time.Second)) {
+		d.Time = formatClock(p.lowTime)
+		p.menu.lowAt.SetTitle(p.execute(p.templates.lowAt, d))
+		p.menu.lowAt.Show()
+	} else {
+		p.menu.lowAt.Hide()
+	}
+	if p.inRangeTime.After(time.Now()) {
+		d.Time = formatClock(p.inRangeTime)
+		p.menu.inRangeAt.SetTitle(p.execute(p.templates.inRangeAt, d))
+		p.menu.inRangeAt.Show()
+	} else {
+		p.menu.inRangeAt.Hide()
+	}
+}
+
+// rangeState names the range the current reading falls in, matching the icon
+// colours.
+func (p *profile) rangeState() string {
+	switch {
+	case p.bg.Value.Timestamp == 0:
+		return "unknown"
+	case p.isLow(p.bg.Value):
+		return "low"
+	case p.isUrgentHigh(p.bg.Value):
+		return "urgent-high"
+	case p.isHigh(p.bg.Value):
+		return "high"
+	}
+	return "in-range"
+}
+
+// age is how long ago the latest reading was taken.
+func (p *profile) age() time.Duration {
+	return p.now().Sub(time.Unix(0, p.bg.Value.Timestamp*int64(time.Millisecond)))
+}
+
+func formatAge(d time.Duration) string {
+	minutes := int(d.Minutes())
+	if minutes < 60 {
+		return tr("%d min", minutes)
+	}
+	return tr("%dh %dm", minutes/60, minutes%60)
+}
+
+func (p *profile) isStale() bool {
+	return p.bg.Value.Timestamp > 0 && p.age() > staleSeconds*time.Second
+}
+
+func (p *profile) title() string {
+	title := p.format()
+	if p.Name != "" {
+		title = p.Name + " " + title
+	}
+	if p.cached {
+		title += " " + tr("(cached, %s old)", formatAge(p.age()))
+	}
+	return title
+}
+
+// refresh fetches the latest reading, recalculates predictions, raises any
+// alerts and stores new readings in the history when there is a db.
+func (p *profile) refresh(db *bolt.DB) error {
+	previousTimestamp := p.bg.Value.Timestamp
+	if time.Since(p.clockCheckedAt) > clockCheckInterval {
+		if s, ok := p.source.(statusSource); ok {
+			p.checkStatus(s)
+		} else if s, ok := p.source.(clockSource); ok {
+			p.checkClock(s)
+		}
+	}
+	start := time.Now()
+	err := p.getBg(db)
+	p.fetchLatency = time.Since(start)
+	p.fetchErr = err
+	p.metrics.observeFetch(p.fetchLatency, err)
+	if err != nil {
+		// The last reading gets older while the site is down too.
+		p.raise(db, p.getStatusAlerts())
+		return err
+	}
+	logDebug("Fetched", "profile", p.logName(), "duration", time.Since(start).Round(time.Millisecond), "timestamp", p.bg.Value.Timestamp, "mmol", p.bg.Value.Value, "direction", p.bg.Direction.Value)
+	p.cached = false
+	if p.bg.Value.Timestamp == previousTimestamp {
+		return nil
+	}
+	if p.bg.PreviousValue.Timestamp > 0 {
+		p.metrics.delta = p.bg.Value.Value - p.bg.PreviousValue.Value
+	}
+	if s, ok := p.source.(onBoardSource); ok {
+		if p.onBoard, err = s.onBoard(); err != nil {
+			logWarn("Failed to fetch IOB and COB", "profile", p.logName(), "err", err)
+		}
+	}
+	if s, ok := p.source.(treatmentSource); ok && p.preset.lastTreatment {
+		if p.lastTreatment, err = s.lastTreatment(); err != nil {
+			logWarn("Failed to fetch the last treatment", "profile", p.logName(), "err", err)
+		}
+	}
+	if db == nil {
+		return nil
+	}
+	if err := p.saveState(db); err != nil {
+		logError("Failed to save state", "profile", p.logName(), "err", err)
+	}
+	return saveHistory(db, p.bucket(historyBucket), historyEntry{
+		Timestamp: p.bg.Value.Timestamp,
+		Value:     p.bg.Value.Value,
+		Direction: p.bg.Direction.Value,
+	})
+}
+
+func (p *profile) alert(db *bolt.DB) {
+	p.raise(db, p.getAlerts())
+}
+
+// raise shows and sends alerts unless they're snoozed, recording them in the
+// alert history when there is a db.
+func (p *profile) raise(db *bolt.DB, alerts []alert) {
+	if len(alerts) < 1 {
+		return
+	}
+	if db != nil {
+		defer p.updateAlertHistoryMenu(db)
+		// Raising an alert changes what has been alerted on, which must
+		// survive a restart even when there's no new reading to save.
+		defer func() {
+			if err := p.saveState(db); err != nil {
+				logError("Failed to save state", "profile", p.logName(), "err", err)
+			}
+		}()
+	}
+	if !sendAlerts {
+		for _, a := range alerts {
+			logDebug("Alert not sent", "profile", p.logName(), "type", a.Type, "message", a.Message)
+		}
+		return
+	}
+	if time.Now().Before(snoozeUntil) {
+		for _, a := range alerts {
+			logInfo("Alert silenced", "profile", p.logName(), "type", a.Type, "message", a.Message, "until", snoozeUntil.Format("15:04"))
+			if db == nil {
+				continue
+			}
+			if _, err := p.recordAlert(db, a, alertSilenced); err != nil {
+				logError("Failed to record alert", "profile", p.logName(), "err", err)
+			}
+		}
+		return
+	}
+	for _, a := range alerts {
+		logInfo("Alert", "profile", p.logName(), "type", a.Type, "message", a.Message)
+		var ack func(status string)
+		if db != nil {
+			key, err := p.recordAlert(db, a, alertShown)
+			if err != nil {
+				logError("Failed to record alert", "profile", p.logName(), "err", err)
+			} else {
+				ack = func(status string) {
+					logInfo("Alert "+status, "profile", p.logName(), "type", a.Type)
+					if err := p.setAlertStatus(db, key, status); err != nil {
+						logError("Failed to update alert history", "profile", p.logName(), "err", err)
+					}
+					p.updateAlertHistoryMenu(db)
+				}
+			}
+		}
+		p.showNotification(a, ack)
+		p.metrics.alerts[a.Type]++
+		p.notifyAll(a)
+	}
+}
+
+func (b *bg) format() string {
+	return fmt.Sprintf("%.1f %s", b.Value.Value, b.Direction.Value)
+}
+
+func (p *profile) getAlerts() (alerts []alert) {
+	b := &p.bg
+	delayLow := p.delayLow()
+	if b.Direction.IsFallback {
+		if b.LastDirectionAlert != "failed" {
+			alerts = append(alerts, alert{"Direction failed", tr("Failed to get BG direction. %.1f", b.Value.Value)})
+			b.LastDirectionAlert = "failed"
+		}
+	} else if b.Value.Value != b.PreviousValue.Value {
+		if b.Direction.IsRising {
+			if b.LastDirectionAlert != "rising" {
+				if p.alertValues["Rising fast"] {
+					alerts = append(alerts, alert{"Rising fast", tr("Rising fast! %.1f %s", b.Value.Value, b.Direction.Value)})
+					b.LastDirectionAlert = "rising"
+				}
+			}
+		} else if b.Direction.IsFalling {
+			if b.LastDirectionAlert != "falling" {
+				if p.alertValues["Falling fast"] {
+					alerts = append(alerts, alert{"Falling fast", tr("Falling fast! %.1f %s", b.Value.Value, b.Direction.Value)})
+					b.LastDirectionAlert = "falling"
+				}
+			}
+		}
+	}
+
+	if p.isLow(b.Value) {
+		if b.LastBgAlert != "low" || p.repeatDue() {
+			if p.alertValues["Low"] && !delayLow {
+				alerts = append(alerts, alert{"Low", tr("Low! %.1f %s", b.Value.Value, b.Direction.Value)})
+				b.LastBgAlert = "low"
+				b.LastBgAlertTime = time.Now().Unix()
+			}
+		}
+	} else if p.isUrgentHigh(b.Value) {
+		if b.LastBgAlert != "high" || p.repeatDue() {
+			if p.alertValues["Urgent high"] {
+				alerts = append(alerts, alert{"Urgent high", tr("Urgent high! %.1f %s", b.Value.Value, b.Direction.Value)})
+				b.LastBgAlert = "high"
+				b.LastBgAlertTime = time.Now().Unix()
+			}
+		}
+	}
+
+	if p.lowTime.After(time.Now()) && p.lowTime.Before(time.Now().Add(predictLowSeconds*time.Second)) {
+		// Only once per reading, so fetching the same reading again or
+		// restarting doesn't repeat it.
+		if p.alertValues["Predicted low"] && !delayLow && b.LastPredictedLowAlert != b.Value.Timestamp {
+			b.LastPredictedLowAlert = b.Value.Timestamp
+			alerts = append(alerts, alert{"Predicted low", tr("Predicted low at %s!", formatClock(p.lowTime))})
+		}
+	}
+
+	alerts = append(alerts, p.getRateAlerts()...)
+	alerts = append(alerts, p.getStatusAlerts()...)
+
+	return
+}
+
+func (p *profile) getBg(db *bolt.DB) error {
+	r, err := p.source.latest()
+	if err != nil {
+		return err
+	}
+	if len(p.recent) < 1 && db != nil {
+		if err := p.loadRecent(db, r.Timestamp); err != nil {
+			logWarn("Failed to load recent readings", "profile", p.logName(), "err", err)
+		}
+	}
+	p.setReading(r)
+	p.alert(db)
+
+	return nil
+}
+
+// setReading makes r the current reading and recalculates the predictions
+// from it.
+func (p *profile) setReading(r reading) {
+	timestamp := r.Timestamp
+	mgdl := r.Mgdl
+	direction := r.Direction
+	_, ok := directions[direction]
+	if !ok {
+		direction = fallbackDirection
+	}
+
+	// Fetching the same reading again mustn't replace the previous one, or
+	// the delta and predictions would be lost until the next reading.
+	b := &p.bg
+	if b.Value.Timestamp == timestamp {
+		return
+	}
+	p.previousArrow = b.Direction.Value
+
+	b.Direction = directions[direction]
+	b.PreviousValue = b.Value
+	b.Value = bgValue{
+		Timestamp: timestamp,
+		Value:     float64(mgdl) / mgdltommol,
+	}
+	p.addRecent(b.Value)
+	p.calculateLowTime()
+	p.calculateInRangeTime()
+	p.checkSuspect(r.Noise)
+}
+
+func (p *profile) getIcon() string {
+	if p.isLow(p.bg.Value) || p.isUrgentHigh(p.bg.Value) {
+		return "red"
+	} else if p.isHigh(p.bg.Value) {
+		return "orange"
+	}
+	return "green"
+}
+
+func (p *profile) calculateLowTime() {
+	b := p.bg
+	if b.Value.Timestamp != b.PreviousValue.Timestamp {
+		var secondsToLow int
+		if b.Value.Value < b.PreviousValue.Value {
+			seconds := (b.Value.Timestamp - b.PreviousValue.Timestamp) / 1000
+			changePerSecond := (b.PreviousValue.Value - b.Value.Value) / float64(seconds)
+			secondsToLow = int((b.Value.Value - p.Low) / changePerSecond)
+			// Predictions count from when the reading was taken, not when
+			// it was fetched.
+			p.lowTime = p.readingTime(b.Value.Timestamp).Add(time.Duration(secondsToLow) * time.Second)
+		} else {
+			p.lowTime = time.Now()
+		}
+	}
+}
+
+func (p *profile) calculateInRangeTime() {
+	b := p.bg
+	if b.Value.Timestamp != b.PreviousValue.Timestamp {
+		seconds := math.Abs(float64((b.Value.Timestamp - b.PreviousValue.Timestamp) / 1000))
+		changePerSecond := math.Abs((b.PreviousValue.Value - b.Value.Value) / seconds)
+		var secondsToInRange int
+		if p.isHigh(b.Value) && b.Value.Value < b.PreviousValue.Value {
+			secondsToInRange = int((b.Value.Value - p.High) / changePerSecond)
+		} else if p.isLow(b.Value) && b.Value.Value > b.PreviousValue.Value {
+			secondsToInRange = int((p.Low - b.Value.Value) / changePerSecond)
+		}
+		p.inRangeTime = time.Now()
+		if secondsToInRange > 0 {
+			p.inRangeTime = p.readingTime(b.Value.Timestamp).Add(time.Duration(secondsToInRange) * time.Second)
+		}
+	}
+}
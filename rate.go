@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultRateMinutes = 15
+const recentWindow = time.Hour
+
+// rateRule is a rate of change alert from the config, e.g. falling faster
+// than 0.1 mmol/L a minute over 15 minutes while below 6. Rate, Below and
+// Above are in Units, mmol (the default) or mgdl, and Below and Above are
+// optional.
+type rateRule struct {
+	Name      string  `json:"name"`
+	Direction string  `json:"direction"`
+	Rate      float64 `json:"rate"`
+	Units     string  `json:"units"`
+	Minutes   int     `json:"minutes"`
+	Below     float64 `json:"below"`
+	Above     float64 `json:"above"`
+}
+
+func (r *rateRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("Rate alerts need a name")
+	}
+	if isAlertType(r.Name) {
+		return fmt.Errorf("Rate alert %q has the same name as a built in alert", r.Name)
+	}
+	if r.Direction != "rising" && r.Direction != "falling" {
+		return fmt.Errorf("Rate alert %q direction must be rising or falling", r.Name)
+	}
+	if r.Rate <= 0 {
+		return fmt.Errorf("Rate alert %q needs a rate above 0", r.Name)
+	}
+	if r.Units != "" && r.Units != "mmol" && r.Units != "mgdl" {
+		return fmt.Errorf("Rate alert %q units must be mmol or mgdl", r.Name)
+	}
+	if r.Minutes == 0 {
+		r.Minutes = defaultRateMinutes
+	}
+	if r.Minutes < 0 || time.Duration(r.Minutes)*time.Minute > recentWindow {
+		return fmt.Errorf("Rate alert %q minutes must be between 1 and %d", r.Name, int(recentWindow.Minutes()))
+	}
+	return nil
+}
+
+// toUnits converts a value in mmol/L to the rule's units.
+func (r *rateRule) toUnits(mmol float64) float64 {
+	if r.Units == "mgdl" {
+		return mmol * mgdltommol
+	}
+	return mmol
+}
+
+func (r *rateRule) unitLabel() string {
+	if r.Units == "mgdl" {
+		return "mg/dL"
+	}
+	return "mmol/L"
+}
+
+// slope is the least squares rate of change in mmol/L per minute of the
+// recent readings within the window, so one noisy reading can't trigger an
+// alert. It needs readings covering at least half the window.
+func (p *profile) slope(window time.Duration) (float64, bool) {
+	latest := p.bg.Value.Timestamp
+	from := latest - int64(window/time.Millisecond)
+	var n, sumX, sumY, sumXY, sumXX float64
+	earliest := latest
+	for _, r := range p.recent {
+		if r.Timestamp < from || r.Timestamp > latest {
+			continue
+		}
+		if r.Timestamp < earliest {
+			earliest = r.Timestamp
+		}
+		x := float64(r.Timestamp-latest) / float64(time.Minute/time.Millisecond)
+		n++
+		sumX += x
+		sumY += r.Value
+		sumXY += x * r.Value
+		sumXX += x * x
+	}
+	if n < 2 || time.Duration(latest-earliest)*time.Millisecond < window/2 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX), true
+}
+
+// addRecent keeps the readings from the last recentWindow for rate alerts.
+func (p *profile) addRecent(v bgValue) {
+	p.recent = append(p.recent, v)
+	from := v.Timestamp - int64(recentWindow/time.Millisecond)
+	for len(p.recent) > 0 && p.recent[0].Timestamp < from {
+		p.recent = p.recent[1:]
+	}
+}
+
+// getRateAlerts checks the profile's rate alerts, raising each once until its
+// condition clears.
+func (p *profile) getRateAlerts() (alerts []alert) {
+	for i := range p.RateAlerts {
+		r := &p.RateAlerts[i]
+		slope, ok := p.slope(time.Duration(r.Minutes) * time.Minute)
+		if !ok {
+			continue
+		}
+		rate := r.toUnits(slope)
+		value := r.toUnits(p.bg.Value.Value)
+		triggered := (r.Direction == "rising" && rate >= r.Rate) || (r.Direction == "falling" && rate <= -r.Rate)
+		if r.Below > 0 && value >= r.Below {
+			triggered = false
+		}
+		if r.Above > 0 && value <= r.Above {
+			triggered = false
+		}
+		if !triggered {
+			delete(p.bg.RateAlerts, r.Name)
+			continue
+		}
+		if p.bg.RateAlerts[r.Name] || !p.alertValues[r.Name] {
+			continue
+		}
+		if p.bg.RateAlerts == nil {
+			p.bg.RateAlerts = map[string]bool{}
+		}
+		p.bg.RateAlerts[r.Name] = true
+		alerts = append(alerts, alert{r.Name, tr("%s! %.1f %s (%+.2f %s/min)", r.Name, p.bg.Value.Value, p.bg.Direction.Value, rate, r.unitLabel())})
+	}
+	return
+}
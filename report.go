@@ -0,0 +1,386 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const hypoMinimumMinutes = 15
+const reportHeight = 300
+const reportMaxValue = 22.0
+const reportWidth = 720
+const veryLowValue = 3.0
+
+type report struct {
+	Name       string
+	Generated  string
+	From       string
+	To         string
+	Readings   int
+	Mean       float64
+	GMI        float64
+	CV         float64
+	TIR        []tirBand
+	HypoEvents int
+	Percentile percentileChart
+	Days       []dayTrace
+}
+
+type tirBand struct {
+	Label   string
+	Colour  string
+	Percent float64
+}
+
+type percentileChart struct {
+	Outer     string
+	Inner     string
+	Median    string
+	LowY      int
+	HighY     int
+	InRange   int
+	HourTicks []tick
+}
+
+type dayTrace struct {
+	Label  string
+	Points string
+}
+
+type tick struct {
+	X     int
+	Label string
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CGM report {{with .Name}}{{.}} {{end}}{{.From}} - {{.To}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+td, th { padding: 4px 12px; text-align: left; }
+svg { background: #fafafa; border: 1px solid #ddd; }
+.tir { display: flex; width: 720px; height: 24px; }
+</style>
+</head>
+<body>
+<h1>Ambulatory glucose profile{{with .Name}} &middot; {{.}}{{end}}</h1>
+<p>{{.From}} to {{.To}} &middot; generated {{.Generated}}</p>
+<table>
+<tr><th>Readings</th><td>{{.Readings}}</td></tr>
+<tr><th>Mean</th><td>{{printf "%.1f" .Mean}} mmol/L</td></tr>
+<tr><th>GMI</th><td>{{printf "%.1f" .GMI}}%</td></tr>
+<tr><th>CV</th><td>{{printf "%.1f" .CV}}%</td></tr>
+<tr><th>Hypo events</th><td>{{.HypoEvents}}</td></tr>
+</table>
+<h2>Time in range</h2>
+<div class="tir">{{range .TIR}}<div style="width: {{printf "%.2f" .Percent}}%; background: {{.Colour}}"></div>{{end}}</div>
+<table>
+{{range .TIR}}<tr><th>{{.Label}}</th><td>{{printf "%.1f" .Percent}}%</td></tr>
+{{end}}</table>
+<h2>Percentiles by hour of day</h2>
+<svg width="720" height="300" viewBox="0 0 720 300">
+<rect x="0" y="{{.Percentile.HighY}}" width="720" height="{{.Percentile.InRange}}" fill="#e8f5e9"/>
+<polygon points="{{.Percentile.Outer}}" fill="#90caf9"/>
+<polygon points="{{.Percentile.Inner}}" fill="#1e88e5"/>
+<polyline points="{{.Percentile.Median}}" fill="none" stroke="#0d47a1" stroke-width="2"/>
+<line x1="0" y1="{{.Percentile.LowY}}" x2="720" y2="{{.Percentile.LowY}}" stroke="#c62828"/>
+<line x1="0" y1="{{.Percentile.HighY}}" x2="720" y2="{{.Percentile.HighY}}" stroke="#ef6c00"/>
+{{range .Percentile.HourTicks}}<text x="{{.X}}" y="295" font-size="10">{{.Label}}</text>
+{{end}}</svg>
+<p>Bands show the 5th-95th and 25th-75th percentiles, the line is the median.</p>
+<h2>Daily overlays</h2>
+<svg width="720" height="300" viewBox="0 0 720 300">
+<line x1="0" y1="{{.Percentile.LowY}}" x2="720" y2="{{.Percentile.LowY}}" stroke="#c62828"/>
+<line x1="0" y1="{{.Percentile.HighY}}" x2="720" y2="{{.Percentile.HighY}}" stroke="#ef6c00"/>
+{{range .Days}}<polyline points="{{.Points}}" fill="none" stroke="#546e7a" stroke-opacity="0.5"><title>{{.Label}}</title></polyline>
+{{end}}{{range .Percentile.HourTicks}}<text x="{{.X}}" y="295" font-size="10">{{.Label}}</text>
+{{end}}</svg>
+</body>
+</html>
+`))
+
+func buildReport(p *profile, entries []historyEntry, from time.Time, to time.Time) report {
+	r := report{
+		Name:      p.Name,
+		Generated: time.Now().Format("2006-01-02 15:04"),
+		From:      from.Format("2006-01-02"),
+		To:        to.Format("2006-01-02"),
+		Readings:  len(entries),
+	}
+	if len(entries) < 1 {
+		return r
+	}
+
+	var sum, veryLow, low, inRange, high, veryHigh float64
+	hours := make([][]float64, 24)
+	days := map[string][]historyEntry{}
+	var dayLabels []string
+	for _, e := range entries {
+		sum += e.Value
+		switch {
+		case e.Value < veryLowValue:
+			veryLow++
+		case e.Value < p.Low:
+			low++
+		case e.Value >= p.Urgenthigh:
+			veryHigh++
+		case e.Value >= p.High:
+			high++
+		default:
+			inRange++
+		}
+		t := e.time()
+		hours[t.Hour()] = append(hours[t.Hour()], e.Value)
+		day := t.Format("2006-01-02")
+		if _, ok := days[day]; !ok {
+			dayLabels = append(dayLabels, day)
+		}
+		days[day] = append(days[day], e)
+	}
+	count := float64(len(entries))
+	r.Mean = sum / count
+	// GMI formula from Bergenstal et al. 2018, using mg/dL.
+	r.GMI = 3.31 + 0.02392*r.Mean*mgdltommol
+	var variance float64
+	for _, e := range entries {
+		variance += math.Pow(e.Value-r.Mean, 2)
+	}
+	r.CV = math.Sqrt(variance/count) / r.Mean * 100
+	r.TIR = []tirBand{
+		{Label: fmt.Sprintf("Very high (≥%.1f)", p.Urgenthigh), Colour: "#b71c1c", Percent: veryHigh / count * 100},
+		{Label: fmt.Sprintf("High (%.1f-%.1f)", p.High, p.Urgenthigh), Colour: "#ef6c00", Percent: high / count * 100},
+		{Label: fmt.Sprintf("In range (%.1f-%.1f)", p.Low, p.High), Colour: "#43a047", Percent: inRange / count * 100},
+		{Label: fmt.Sprintf("Low (%.1f-%.1f)", veryLowValue, p.Low), Colour: "#e53935", Percent: low / count * 100},
+		{Label: fmt.Sprintf("Very low (<%.1f)", veryLowValue), Colour: "#7f0000", Percent: veryLow / count * 100},
+	}
+	r.HypoEvents = countHypoEvents(entries, p.Low)
+	r.Percentile = buildPercentileChart(p, hours)
+	for _, day := range dayLabels {
+		r.Days = append(r.Days, dayTrace{
+			Label:  day,
+			Points: dayPoints(days[day]),
+		})
+	}
+
+	return r
+}
+
+// countHypoEvents counts runs of readings below the low target lasting at
+// least hypoMinimumMinutes.
+func countHypoEvents(entries []historyEntry, low float64) (events int) {
+	var start int64
+	for _, e := range entries {
+		if e.Value < low {
+			if start == 0 {
+				start = e.Timestamp
+			}
+			continue
+		}
+		if start > 0 && e.Timestamp-start >= hypoMinimumMinutes*60*1000 {
+			events++
+		}
+		start = 0
+	}
+	if start > 0 && entries[len(entries)-1].Timestamp-start >= hypoMinimumMinutes*60*1000 {
+		events++
+	}
+	return
+}
+
+func buildPercentileChart(p *profile, hours [][]float64) (c percentileChart) {
+	var p5, p25, p50, p75, p95 []string
+	for hour, values := range hours {
+		if len(values) < 1 {
+			continue
+		}
+		sort.Float64s(values)
+		x := reportX(float64(hour) + 0.5)
+		p5 = append(p5, point(x, percentile(values, 5)))
+		p25 = append(p25, point(x, percentile(values, 25)))
+		p50 = append(p50, point(x, percentile(values, 50)))
+		p75 = append(p75, point(x, percentile(values, 75)))
+		p95 = append(p95, point(x, percentile(values, 95)))
+	}
+	c.Outer = strings.Join(append(p95, reversed(p5)...), " ")
+	c.Inner = strings.Join(append(p75, reversed(p25)...), " ")
+	c.Median = strings.Join(p50, " ")
+	c.LowY = int(reportY(p.Low))
+	c.HighY = int(reportY(p.High))
+	c.InRange = c.LowY - c.HighY
+	for hour := 0; hour < 24; hour += 3 {
+		c.HourTicks = append(c.HourTicks, tick{
+			X:     int(reportX(float64(hour))),
+			Label: fmt.Sprintf("%02d:00", hour),
+		})
+	}
+	return
+}
+
+func dayPoints(entries []historyEntry) string {
+	points := make([]string, 0, len(entries))
+	for _, e := range entries {
+		t := e.time()
+		hours := float64(t.Hour()) + float64(t.Minute())/60
+		points = append(points, point(reportX(hours), e.Value))
+	}
+	return strings.Join(points, " ")
+}
+
+// percentile returns the p-th percentile of sorted values, interpolating
+// between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func point(x float64, value float64) string {
+	return fmt.Sprintf("%.1f,%.1f", x, reportY(value))
+}
+
+func reportX(hours float64) float64 {
+	return hours / 24 * reportWidth
+}
+
+func reportY(value float64) float64 {
+	return reportHeight - math.Min(value, reportMaxValue)/reportMaxValue*reportHeight
+}
+
+func reversed(s []string) []string {
+	r := make([]string, len(s))
+	for i, v := range s {
+		r[len(s)-1-i] = v
+	}
+	return r
+}
+
+// generateReport renders an HTML report of the last days of stored history
+// and returns the filename it was written to.
+func generateReport(db *bolt.DB, p *profile, days int, filename string) (string, error) {
+	if err := p.backfillHistory(db); err != nil {
+		logWarn("Failed to backfill history", "profile", p.logName(), "err", err)
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -days)
+	entries, err := loadHistory(db, p.bucket(historyBucket), from, to)
+	if err != nil {
+		return "", err
+	}
+	if filename == "" {
+		dir, err := reportDir()
+		if err != nil {
+			return "", err
+		}
+		if p.Name == "" {
+			filename = filepath.Join(dir, fmt.Sprintf("cgm-report-%s.html", to.Format("2006-01-02")))
+		} else {
+			filename = filepath.Join(dir, fmt.Sprintf("cgm-report-%s-%s.html", p.Name, to.Format("2006-01-02")))
+		}
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if err := reportTemplate.Execute(file, buildReport(p, entries, from, to)); err != nil {
+		return "", err
+	}
+	logInfo("Wrote report", "profile", p.logName(), "file", filename)
+	return filename, nil
+}
+
+// reportDir is where reports are written unless a filename is given,
+// $XDG_DATA_HOME/cgm/reports.
+func reportDir() (string, error) {
+	return xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"), "reports")
+}
+
+func openReport(db *bolt.DB, p *profile) {
+	filename, err := generateReport(db, p, historyDays, "")
+	if err != nil {
+		logError("Failed to generate report", "profile", p.logName(), "err", err)
+		return
+	}
+	exec.Command("xdg-open", filename).Start()
+}
+
+func runReport(db *bolt.DB, arguments []string) {
+	logToStderr()
+	reportFlags := flag.NewFlagSet("report", flag.ExitOnError)
+	days := reportFlags.Int("days", historyDays, "Number of days to include in the report")
+	out := reportFlags.String("out", "", "Report filename (default $XDG_DATA_HOME/cgm/reports/cgm-report-<date>.html)")
+	name := reportFlags.String("profile", "", "Name of the profile to report on (default the first profile)")
+	reportFlags.Parse(arguments)
+
+	p := profiles[0]
+	if *name != "" {
+		p = findProfile(*name)
+		if p == nil {
+			logFatal(fmt.Sprintf("No profile named %q", *name))
+		}
+	}
+	if db == nil {
+		// The running tray has the db, so it's asked to write the report.
+		filename := *out
+		if filename != "" {
+			var err error
+			if filename, err = filepath.Abs(filename); err != nil {
+				logFatal("Failed to generate report", "err", err)
+			}
+		}
+		filename, err := remoteReport(p.Name, *days, filename)
+		if err != nil {
+			logFatal("cgm.db is in use and the tray couldn't generate the report over D-Bus", "err", err)
+		}
+		fmt.Println(filename)
+		return
+	}
+	filename, err := generateReport(db, p, *days, *out)
+	if err != nil {
+		logFatal("Failed to generate report", "err", err)
+	}
+	fmt.Println(filename)
+}
+
+// scheduleWeeklyReport generates a report every Sunday night, remembering the
+// last run in the keys bucket so restarts don't produce duplicates.
+func scheduleWeeklyReport(db *bolt.DB) {
+	for range time.Tick(time.Minute * 1) {
+		now := time.Now()
+		if now.Weekday() != time.Sunday || now.Hour() < 22 {
+			continue
+		}
+		today := now.Format("2006-01-02")
+		var last string
+		db.View(func(tx *bolt.Tx) error {
+			last = string(tx.Bucket([]byte("keys")).Get([]byte("lastWeeklyReport")))
+			return nil
+		})
+		if last == today {
+			continue
+		}
+		for _, p := range profiles {
+			if _, err := generateReport(db, p, 7, ""); err != nil {
+				logError("Failed to generate weekly report", "profile", p.logName(), "err", err)
+			}
+		}
+		db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("keys")).Put([]byte("lastWeeklyReport"), []byte(today))
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const serverHistoryHours = 3
+
+type profileState struct {
+	Name        string          `json:"name"`
+	Source      string          `json:"source"`
+	Bg          bg              `json:"bg"`
+	Title       string          `json:"title"`
+	Range       string          `json:"range"`
+	Suspect     string          `json:"suspect,omitempty"`
+	SuspectAt   int64           `json:"suspectAt,omitempty"`
+	Alerts      alertState      `json:"alerts"`
+	Predictions predictionState `json:"predictions"`
+	History     []historyEntry  `json:"history,omitempty"`
+}
+
+type alertState struct {
+	Enabled            map[string]bool `json:"enabled"`
+	LastBgAlert        string          `json:"lastBgAlert"`
+	LastDirectionAlert string          `json:"lastDirectionAlert"`
+}
+
+type predictionState struct {
+	LowAt     *time.Time `json:"lowAt"`
+	InRangeAt *time.Time `json:"inRangeAt"`
+}
+
+// serve runs the local HTTP API. It only listens on loopback addresses since
+// the readings are health data.
+func serve(db *bolt.DB, addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		logError("Invalid HTTP API address", "addr", addr, "err", err)
+		return
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		logError("Refusing to serve the HTTP API on a non-localhost address", "addr", addr)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/current", func(w http.ResponseWriter, r *http.Request) {
+		writeProfileStates(w, r, db, false)
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		writeProfileStates(w, r, db, true)
+	})
+	mux.HandleFunc("/metrics", writeMetrics)
+	logError("Stopped serving the HTTP API", "addr", addr, "err", http.ListenAndServe(addr, mux))
+}
+
+// writeProfileStates responds with the state of every profile, or the one
+// named by the profile query parameter.
+func writeProfileStates(w http.ResponseWriter, r *http.Request, db *bolt.DB, withHistory bool) {
+	hours := serverHistoryHours
+	if h := r.URL.Query().Get("hours"); h != "" {
+		var err error
+		if hours, err = strconv.Atoi(h); err != nil || hours < 1 {
+			http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	name := r.URL.Query().Get("profile")
+	var states []profileState
+	for _, p := range profiles {
+		if name != "" && p.Name != name {
+			continue
+		}
+		state := p.state()
+		if withHistory {
+			var err error
+			state.History, err = loadHistory(db, p.bucket(historyBucket), time.Now().Add(-time.Duration(hours)*time.Hour), time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		states = append(states, state)
+	}
+	if name != "" && len(states) < 1 {
+		http.Error(w, fmt.Sprintf("No profile named %q", name), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+// state snapshots the profile while no refresh is in progress.
+func (p *profile) state() profileState {
+	setBgMutex.Lock()
+	defer setBgMutex.Unlock()
+
+	s := profileState{
+		Name:    p.Name,
+		Source:  p.Source,
+		Bg:      p.bg,
+		Title:   p.title(),
+		Range:   p.rangeState(),
+		Suspect: p.suspect,
+		Alerts: alertState{
+			Enabled:            map[string]bool{},
+			LastBgAlert:        p.bg.LastBgAlert,
+			LastDirectionAlert: p.bg.LastDirectionAlert,
+		},
+	}
+	if s.Source == "" {
+		s.Source = "nightscout"
+	}
+	if p.suspect != "" {
+		s.SuspectAt = p.suspectAt
+	}
+	for k, v := range p.alertValues {
+		s.Alerts.Enabled[k] = v
+	}
+	if p.lowTime.After(time.Now()) && p.lowTime.Before(time.Now().Add(predictLowSeconds*time.Second)) {
+		lowAt := p.lowTime
+		s.Predictions.LowAt = &lowAt
+	}
+	if p.inRangeTime.After(time.Now()) {
+		inRangeAt := p.inRangeTime
+		s.Predictions.InRangeAt = &inRangeAt
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/getlantern/systray"
+)
+
+// siteStatus is what a nightscout site reports about itself in status.json.
+type siteStatus struct {
+	Version    string
+	Units      string
+	Plugins    []string
+	Thresholds *serverThresholds
+	ServerTime time.Time
+}
+
+// serverThresholds are nightscout's BG_HIGH, BG_TARGET_TOP, BG_TARGET_BOTTOM
+// and BG_LOW settings, in mg/dL.
+type serverThresholds struct {
+	BgHigh         float64 `json:"bgHigh"`
+	BgTargetTop    float64 `json:"bgTargetTop"`
+	BgTargetBottom float64 `json:"bgTargetBottom"`
+	BgLow          float64 `json:"bgLow"`
+}
+
+// local maps the server's settings onto the tray's thresholds. The target
+// range gives the high and low thresholds and BG_HIGH the urgent high, which
+// is how nightscout itself colours readings. BG_LOW has no equivalent.
+func (t serverThresholds) local() thresholds {
+	return thresholds{
+		Urgenthigh: round(t.BgHigh/mgdltommol, 1),
+		High:       round(t.BgTargetTop/mgdltommol, 1),
+		Low:        round(t.BgTargetBottom/mgdltommol, 1),
+	}
+}
+
+type serverMenu struct {
+	parent     *systray.MenuItem
+	version    *systray.MenuItem
+	plugins    *systray.MenuItem
+	units      *systray.MenuItem
+	targets    *systray.MenuItem
+	alarms     *systray.MenuItem
+	battery    *systray.MenuItem
+	upload     *systray.MenuItem
+	api        *systray.MenuItem
+	thresholds *systray.MenuItem
+}
+
+// checkStatus fetches the site's status, which also gives the server clock.
+func (p *profile) checkStatus(s statusSource) {
+	p.clockCheckedAt = time.Now()
+	start := time.Now()
+	st, err := s.status()
+	if err != nil {
+		logWarn("Failed to fetch the server status", "profile", p.logName(), "err", err)
+		return
+	}
+	p.siteStatus = &st
+	logDebug("Fetched the server status", "profile", p.logName(), "version", st.Version, "units", st.Units)
+	if !st.ServerTime.IsZero() {
+		p.setClockOffset(start, st.ServerTime)
+	}
+	p.applyServerThresholds()
+}
+
+// applyServerThresholds switches between the server's thresholds and the ones
+// from the flags or config.
+func (p *profile) applyServerThresholds() {
+	if p.ServerThresholds && p.siteStatus != nil && p.siteStatus.Thresholds != nil {
+		t := p.siteStatus.Thresholds.local()
+		if t != p.thresholds {
+			logInfo("Using the server's thresholds", "profile", p.logName(), "low", t.Low, "high", t.High, "urgentHigh", t.Urgenthigh)
+		}
+		p.thresholds = t
+		return
+	}
+	p.thresholds = p.localThresholds
+}
+
+// addServerMenu adds the Server submenu, for sources that report their status.
+func (p *profile) addServerMenu(db *bolt.DB) {
+	if _, ok := p.source.(statusSource); !ok {
+		return
+	}
+	m := &p.menu.server
+	m.parent = p.addMenuItem(tr("Server"))
+	for _, item := range []**systray.MenuItem{&m.version, &m.plugins, &m.units, &m.targets, &m.alarms, &m.battery, &m.upload, &m.api} {
+		*item = m.parent.AddSubMenuItem("", "")
+		(*item).Disable()
+		(*item).Hide()
+	}
+
+	key := []byte("serverThresholds")
+	db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(p.bucket("keys"))
+		if err != nil {
+			return err
+		}
+		if v := b.Get(key); len(v) > 0 {
+			p.ServerThresholds = string(v) == "true"
+		}
+		return nil
+	})
+	m.thresholds = m.parent.AddSubMenuItemCheckbox(tr("Use server thresholds"), "", p.ServerThresholds)
+	go func() {
+		for range m.thresholds.ClickedCh {
+			setBgMutex.Lock()
+			p.ServerThresholds = !p.ServerThresholds
+			if p.ServerThresholds {
+				m.thresholds.Check()
+			} else {
+				m.thresholds.Uncheck()
+			}
+			p.applyServerThresholds()
+			render()
+			setBgMutex.Unlock()
+			db.Update(func(tx *bolt.Tx) error {
+				v := "false"
+				if p.ServerThresholds {
+					v = "true"
+				}
+				return tx.Bucket(p.bucket("keys")).Put(key, []byte(v))
+			})
+		}
+	}()
+}
+
+func (p *profile) updateServerMenu() {
+	m := &p.menu.server
+	if m.parent == nil {
+		return
+	}
+	if p.fetchErr != nil {
+		setMenuItem(m.api, tr("API unreachable: %s", p.fetchErr))
+	} else if p.fetchLatency > 0 {
+		setMenuItem(m.api, tr("API reachable, %d ms", p.fetchLatency.Milliseconds()))
+	}
+	if p.bg.Value.Timestamp > 0 {
+		upload := p.readingTime(p.bg.Value.Timestamp)
+		setMenuItem(m.upload, tr("Last upload %s (%s ago)", formatClock(upload), formatAge(time.Since(upload))))
+	}
+	if p.onBoard.Battery != nil {
+		setMenuItem(m.battery, tr("Uploader battery %d%%", *p.onBoard.Battery))
+	}
+	st := p.siteStatus
+	if st == nil {
+		return
+	}
+	if st.Version != "" {
+		setMenuItem(m.version, tr("Nightscout %s", st.Version))
+	}
+	if len(st.Plugins) > 0 {
+		setMenuItem(m.plugins, tr("Plugins: %s", strings.Join(st.Plugins, ", ")))
+	}
+	if st.Units != "" {
+		setMenuItem(m.units, tr("Units: %s", st.Units))
+	}
+	if t := st.Thresholds; t != nil {
+		setMenuItem(m.targets, tr("Target range %.1f–%.1f", t.BgTargetBottom/mgdltommol, t.BgTargetTop/mgdltommol))
+		setMenuItem(m.alarms, tr("Alarms below %.1f and above %.1f", t.BgLow/mgdltommol, t.BgHigh/mgdltommol))
+	}
+}
+
+func setMenuItem(item *systray.MenuItem, title string) {
+	item.SetTitle(title)
+	item.Show()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const socketMaxBackoff = 5 * time.Minute
+
+// pusher is implemented by sources that can announce new readings as they
+// arrive. While connected the source is not polled.
+type pusher interface {
+	subscribe(update func())
+	connected() bool
+}
+
+type socketOpen struct {
+	PingInterval int `json:"pingInterval"`
+	PingTimeout  int `json:"pingTimeout"`
+}
+
+// subscribe keeps a socket.io connection to nightscout open, calling update
+// whenever the server pushes new sgvs, and reconnects with backoff when the
+// connection drops.
+func (s *nightscoutSource) subscribe(update func()) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.listen(update)
+		atomic.StoreInt32(&s.socketConnected, 0)
+		if time.Since(start) > socketMaxBackoff {
+			backoff = time.Second
+		}
+		logWarn("Nightscout socket closed, polling until it reconnects", "url", s.url, "retry", backoff, "err", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > socketMaxBackoff {
+			backoff = socketMaxBackoff
+		}
+	}
+}
+
+func (s *nightscoutSource) connected() bool {
+	return atomic.LoadInt32(&s.socketConnected) == 1
+}
+
+func (s *nightscoutSource) socketUrl() string {
+	u := s.url + "/socket.io/?EIO=4&transport=websocket"
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(u, "http://")
+}
+
+func (s *nightscoutSource) listen(update func()) error {
+	conn, _, err := websocket.DefaultDialer.Dial(s.socketUrl(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if len(message) < 1 || message[0] != '0' {
+		return fmt.Errorf("Unexpected socket handshake %q", message)
+	}
+	var open socketOpen
+	if err := json.Unmarshal(message[1:], &open); err != nil {
+		return err
+	}
+	timeout := time.Duration(open.PingInterval+open.PingTimeout) * time.Millisecond
+
+	authorize, err := json.Marshal([]interface{}{"authorize", map[string]interface{}{
+		"client":  "cgm",
+		"secret":  s.hashedSecret(),
+		"token":   s.token,
+		"history": 1,
+	}})
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("40")); err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, append([]byte("421"), authorize...)); err != nil {
+		return err
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		packet := string(message)
+		switch {
+		case packet == "2":
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("3")); err != nil {
+				return err
+			}
+		case packet == "1" || strings.HasPrefix(packet, "41"):
+			return fmt.Errorf("Server closed the socket")
+		case strings.HasPrefix(packet, "44"):
+			return fmt.Errorf("Socket connection refused: %s", packet[2:])
+		case strings.HasPrefix(packet, "431"):
+			var ack []struct {
+				Read bool `json:"read"`
+			}
+			if err := json.Unmarshal(message[3:], &ack); err != nil {
+				return err
+			}
+			if len(ack) < 1 || !ack[0].Read {
+				return fmt.Errorf("Not authorized to read from the socket")
+			}
+			atomic.StoreInt32(&s.socketConnected, 1)
+		case strings.HasPrefix(packet, "42"):
+			var event []json.RawMessage
+			if err := json.Unmarshal(message[2:], &event); err != nil || len(event) < 2 {
+				continue
+			}
+			var name string
+			json.Unmarshal(event[0], &name)
+			var data struct {
+				Sgvs []json.RawMessage `json:"sgvs"`
+			}
+			json.Unmarshal(event[1], &data)
+			if name == "dataUpdate" && len(data.Sgvs) > 0 {
+				update()
+			}
+		}
+	}
+}
+
+func (s *nightscoutSource) hashedSecret() string {
+	if s.apiSecret == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s.apiSecret)))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const sourceTimeout = 30 * time.Second
+
+// sourceClient is used for all fetches so a site that's down can't hang the
+// tray.
+var sourceClient = &http.Client{Timeout: sourceTimeout}
+
+// source is where a profile's readings come from. Directions are reported
+// using the nightscout names used as keys in directions, and interval is how
+// often the source receives a new reading.
+type source interface {
+	latest() (reading, error)
+	history(since time.Time) ([]reading, error)
+	interval() time.Duration
+}
+
+// onBoardSource is implemented by sources that know the insulin and carbs on
+// board. Either may be nil when the site doesn't report it.
+type onBoardSource interface {
+	onBoard() (onBoard, error)
+}
+
+// treatmentSource is implemented by sources that record treatments such as
+// insulin and carbs.
+type treatmentSource interface {
+	lastTreatment() (time.Time, error)
+}
+
+// carbSource is implemented by sources that carbs can be logged to.
+type carbSource interface {
+	logCarbs(grams int) error
+}
+
+// statusSource is implemented by sources that describe the server's own
+// status and settings.
+type statusSource interface {
+	status() (siteStatus, error)
+}
+
+// clockSource is implemented by sources that can report the server's clock,
+// so reading ages don't depend on the local clock being right.
+type clockSource interface {
+	serverTime() (time.Time, error)
+}
+
+// onBoard also carries when the loop last ran and the uploader's battery
+// level, nil when the site doesn't report them.
+type onBoard struct {
+	IOB      *float64
+	COB      *float64
+	LastLoop *time.Time
+	Battery  *int
+}
+
+// reading is a single CGM value. Noise is nightscout's sensor noise level,
+// from 1 for clean to 4 for heavy, or 0 when the source doesn't say.
+type reading struct {
+	Timestamp int64
+	Mgdl      int
+	Direction string
+	Noise     int
+}
+
+type nightscoutSource struct {
+	url             string
+	token           string
+	apiSecret       string
+	socketConnected int32
+}
+
+func (p *profile) newSource() (source, error) {
+	switch p.Source {
+	case "", "nightscout":
+		if p.Url == "" {
+			return nil, fmt.Errorf("A nightscout URL is required")
+		}
+		return &nightscoutSource{
+			url:       p.Url,
+			token:     p.Token,
+			apiSecret: p.ApiSecret,
+		}, nil
+	case "dexcom":
+		return newDexcomSource(p.Username, p.Password, p.Region, p.Server)
+	case "libre":
+		return newLibreSource(p.Username, p.Password, p.Region, p.Server, p.Patient)
+	}
+	return nil, fmt.Errorf("Unknown source %q", p.Source)
+}
+
+func (s *nightscoutSource) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", s.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(req)
+}
+
+// do sends the request with the site's token or API secret.
+func (s *nightscoutSource) do(req *http.Request) (*http.Response, error) {
+	if s.token != "" {
+		q := req.URL.Query()
+		q.Set("token", s.token)
+		req.URL.RawQuery = q.Encode()
+	}
+	if s.apiSecret != "" {
+		req.Header.Set("api-secret", s.hashedSecret())
+	}
+	return sourceClient.Do(req)
+}
+
+// latest reads the newest entry as JSON rather than the default TSV, since
+// that includes the sensor noise.
+func (s *nightscoutSource) latest() (reading, error) {
+	readings, err := s.entries("/api/v1/entries/sgv.json?count=1")
+	if err != nil {
+		return reading{}, err
+	}
+	if len(readings) < 1 {
+		return reading{}, fmt.Errorf("No entries found at %s", s.url)
+	}
+	return readings[0], nil
+}
+
+func (s *nightscoutSource) history(since time.Time) ([]reading, error) {
+	ms := since.UnixNano() / int64(time.Millisecond)
+	count := int(time.Since(since)/s.interval()) + 1
+	return s.entries(fmt.Sprintf("/api/v1/entries/sgv.json?count=%d&find[date][$gt]=%d", count, ms))
+}
+
+func (s *nightscoutSource) entries(path string) ([]reading, error) {
+	resp, err := s.get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch entries from %s: %s", s.url, resp.Status)
+	}
+	var ns []nightscoutEntry
+	if err := json.NewDecoder(resp.Body).Decode(&ns); err != nil {
+		return nil, err
+	}
+	readings := make([]reading, 0, len(ns))
+	for _, e := range ns {
+		readings = append(readings, reading{
+			Timestamp: e.Date,
+			Mgdl:      e.Sgv,
+			Direction: e.Direction,
+			Noise:     e.Noise,
+		})
+	}
+	return readings, nil
+}
+
+func (s *nightscoutSource) interval() time.Duration {
+	return 5 * time.Minute
+}
+
+func (s *nightscoutSource) onBoard() (o onBoard, err error) {
+	resp, err := s.get("/api/v2/properties/iob,cob,loop,openaps,upbat")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return o, fmt.Errorf("Failed to fetch IOB and COB: %s", resp.Status)
+	}
+	var properties struct {
+		Iob *struct {
+			Iob *float64 `json:"iob"`
+		} `json:"iob"`
+		Cob *struct {
+			Cob *float64 `json:"cob"`
+		} `json:"cob"`
+		Loop *struct {
+			LastOkMoment *time.Time `json:"lastOkMoment"`
+		} `json:"loop"`
+		Openaps *struct {
+			LastLoopMoment *time.Time `json:"lastLoopMoment"`
+		} `json:"openaps"`
+		Upbat *struct {
+			Level *int `json:"level"`
+		} `json:"upbat"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&properties); err != nil {
+		return
+	}
+	if properties.Iob != nil {
+		o.IOB = properties.Iob.Iob
+	}
+	if properties.Cob != nil {
+		o.COB = properties.Cob.Cob
+	}
+	if properties.Loop != nil {
+		o.LastLoop = properties.Loop.LastOkMoment
+	}
+	if properties.Openaps != nil && properties.Openaps.LastLoopMoment != nil {
+		o.LastLoop = properties.Openaps.LastLoopMoment
+	}
+	if properties.Upbat != nil {
+		o.Battery = properties.Upbat.Level
+	}
+	return
+}
+
+func (s *nightscoutSource) lastTreatment() (time.Time, error) {
+	resp, err := s.get("/api/v1/treatments.json?count=1")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("Failed to fetch treatments: %s", resp.Status)
+	}
+	var treatments []struct {
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&treatments); err != nil {
+		return time.Time{}, err
+	}
+	if len(treatments) < 1 {
+		return time.Time{}, nil
+	}
+	return treatments[0].CreatedAt, nil
+}
+
+// logCarbs records a carb correction treatment, which needs a token or API
+// secret allowed to write treatments.
+func (s *nightscoutSource) logCarbs(grams int) error {
+	body, err := json.Marshal([]map[string]interface{}{{
+		"eventType":  "Carb Correction",
+		"carbs":      grams,
+		"enteredBy":  "cgm",
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+	}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url+"/api/v1/treatments", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to log carbs: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *nightscoutSource) serverTime() (time.Time, error) {
+	st, err := s.status()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if st.ServerTime.IsZero() {
+		return time.Time{}, fmt.Errorf("Status has no server time")
+	}
+	return st.ServerTime, nil
+}
+
+func (s *nightscoutSource) status() (st siteStatus, err error) {
+	resp, err := s.get("/api/v1/status.json")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("Failed to fetch status: %s", resp.Status)
+	}
+	var status struct {
+		ServerTimeEpoch int64  `json:"serverTimeEpoch"`
+		Version         string `json:"version"`
+		Settings        struct {
+			Units      string            `json:"units"`
+			Enable     []string          `json:"enable"`
+			Thresholds *serverThresholds `json:"thresholds"`
+		} `json:"settings"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return
+	}
+	st = siteStatus{
+		Version:    status.Version,
+		Units:      status.Settings.Units,
+		Plugins:    status.Settings.Enable,
+		Thresholds: status.Settings.Thresholds,
+	}
+	if status.ServerTimeEpoch > 0 {
+		st.ServerTime = time.Unix(0, status.ServerTimeEpoch*int64(time.Millisecond))
+	}
+	return
+}
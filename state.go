@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const stateBucket = "state"
+
+// savedState is the last known state of a profile, kept so the tray can show
+// something straight away on startup and knows which alerts were already
+// raised.
+type savedState struct {
+	Bg            bg        `json:"bg"`
+	PreviousArrow string    `json:"previousArrow"`
+	LowTime       time.Time `json:"lowTime"`
+	InRangeTime   time.Time `json:"inRangeTime"`
+	OnBoard       onBoard   `json:"onBoard"`
+	LastTreatment time.Time `json:"lastTreatment"`
+}
+
+func (p *profile) saveState(db *bolt.DB) error {
+	data, err := json.Marshal(savedState{
+		Bg:            p.bg,
+		PreviousArrow: p.previousArrow,
+		LowTime:       p.lowTime,
+		InRangeTime:   p.inRangeTime,
+		OnBoard:       p.onBoard,
+		LastTreatment: p.lastTreatment,
+	})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(p.bucket(stateBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("last"), data)
+	})
+}
+
+// restoreState loads the state saved by the last run, marking it as cached
+// until a fresh reading arrives.
+func (p *profile) restoreState(db *bolt.DB) error {
+	var s savedState
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket(stateBucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte("last"))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &s)
+	})
+	if err != nil || s.Bg.Value.Timestamp == 0 {
+		return err
+	}
+	p.bg = s.Bg
+	p.previousArrow = s.PreviousArrow
+	p.lowTime = s.LowTime
+	p.inRangeTime = s.InRangeTime
+	p.onBoard = s.OnBoard
+	p.lastTreatment = s.LastTreatment
+	p.cached = true
+	return nil
+}
+
+// restoreStates restores every profile and shows the cached readings before
+// the first fetch, which may take a while if a site is down.
+func restoreStates(db *bolt.DB) {
+	for _, p := range profiles {
+		if err := p.restoreState(db); err != nil {
+			logWarn("Failed to restore state", "profile", p.logName(), "err", err)
+		}
+	}
+	setBgMutex.Lock()
+	render()
+	setBgMutex.Unlock()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// compressionDrop is a fall per deltaMinutes too fast to be real, around
+// twice the fastest glucose normally falls. Together with landing near the
+// low threshold it's the pattern of lying on the sensor overnight.
+const compressionDrop = 1.5
+
+// compressionMargin is how far above the low threshold a sudden drop still
+// counts as a possible compression low.
+const compressionMargin = 1.0
+
+// heavyNoise is the nightscout noise level from which readings are suspect.
+const heavyNoise = 3
+
+// noiseWindow and noiseReversals describe a sensor bouncing around: that many
+// big changes of direction within the window.
+const noiseWindow = 30 * time.Minute
+const noiseReversals = 3
+const noiseJump = 0.5
+
+// compressionKept is how long a confirmed compression low stays marked after
+// the dipped reading.
+const compressionKept = 30 * time.Minute
+
+// Reasons a reading is suspect. A compression low is only possible until the
+// next reading rebounds, which confirms it.
+const (
+	suspectCompression = "Possible compression low"
+	suspectCompressed  = "Compression low"
+	suspectNoise       = "Sensor noise"
+)
+
+// checkSuspect works out whether the current reading looks like a sensor
+// artifact rather than a real change. A fast drop near the low threshold is
+// marked as a possible compression low, then confirmed when the next reading
+// rebounds, keeping the mark on the dipped reading. Without a rebound the low
+// was real and the mark is cleared.
+func (p *profile) checkSuspect(noise int) {
+	delta, ok := p.bg.delta()
+	if p.suspect == suspectCompression && p.suspectAt == p.bg.PreviousValue.Timestamp && ok && delta >= compressionDrop {
+		p.suspect = suspectCompressed
+		logInfo("Reading rebounded, confirming a compression low", "profile", p.logName(), "mmol", p.bg.PreviousValue.Value)
+		return
+	}
+	var reason string
+	switch {
+	case ok && delta <= -compressionDrop && p.bg.Value.Value < p.Low+compressionMargin:
+		reason = suspectCompression
+	case noise >= heavyNoise || p.isNoisy():
+		reason = suspectNoise
+	}
+	if reason == "" && p.suspect == suspectCompressed && p.bg.Value.Timestamp-p.suspectAt < int64(compressionKept/time.Millisecond) {
+		return
+	}
+	p.suspect = reason
+	p.suspectAt = p.bg.Value.Timestamp
+}
+
+// suspectText describes why the reading is suspect, or which earlier reading
+// was a compression low.
+func (p *profile) suspectText() string {
+	if p.suspect == suspectCompressed {
+		return tr("Compression low at %s", formatClock(p.readingTime(p.suspectAt)))
+	}
+	return tr(p.suspect)
+}
+
+// isNoisy is true when the recent readings keep jumping up and down.
+func (p *profile) isNoisy() bool {
+	from := p.bg.Value.Timestamp - int64(noiseWindow/time.Millisecond)
+	var reversals int
+	var last float64
+	for i := 1; i < len(p.recent); i++ {
+		if p.recent[i-1].Timestamp < from {
+			continue
+		}
+		change := p.recent[i].Value - p.recent[i-1].Value
+		if math.Abs(change) < noiseJump {
+			continue
+		}
+		if last != 0 && (change > 0) != (last > 0) {
+			reversals++
+		}
+		last = change
+	}
+	return reversals >= noiseReversals
+}
+
+// delayLow is true when low alerts should wait for the next reading because
+// this one looks like a compression low. Only one reading is skipped, so a
+// real fast drop still alerts.
+func (p *profile) delayLow() bool {
+	if !p.DelayCompressionLows || p.suspect != suspectCompression {
+		p.lowDelayedAt = 0
+		return false
+	}
+	if p.lowDelayedAt != 0 && p.lowDelayedAt != p.bg.Value.Timestamp {
+		return false
+	}
+	if p.lowDelayedAt == 0 {
+		logInfo("Delaying low alerts for a possible compression low", "profile", p.logName(), "mmol", p.bg.Value.Value)
+	}
+	p.lowDelayedAt = p.bg.Value.Timestamp
+	return true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const deltaMinutes = 5
+
+const defaultTitleTemplate = "{{.Value}} {{.Arrow}}{{with .Delta}} {{.}}{{end}}"
+
+// defaultTemplates are used for any template a profile doesn't set, with
+// labels in the user's language. The title can also be changed for every
+// profile with -title.
+func defaultTemplates() textTemplates {
+	return textTemplates{
+		Title:     defaultTitleTemplate,
+		Previous:  tr("Previous bg") + ": {{.Value}} {{.Arrow}}",
+		LowAt:     tr("Low at") + ": {{.Time}}",
+		InRangeAt: tr("In range at") + ": {{.Time}}",
+		Rate:      tr("Rate") + ": {{.Rate}} mg/dL/min",
+	}
+}
+
+// textTemplates are the text/template strings for the tray title and menu
+// labels as written in the config.
+type textTemplates struct {
+	Title     string `json:"title"`
+	Previous  string `json:"previous"`
+	LowAt     string `json:"lowAt"`
+	InRangeAt string `json:"inRangeAt"`
+	Rate      string `json:"rate"`
+}
+
+type parsedTemplates struct {
+	title     *template.Template
+	previous  *template.Template
+	lowAt     *template.Template
+	inRangeAt *template.Template
+	rate      *template.Template
+}
+
+// templateData is what the templates can show. Everything is preformatted so
+// templates don't need any functions, and fields that aren't known are empty
+// so they can be left out with {{with}}.
+type templateData struct {
+	Name    string
+	Value   string
+	Mgdl    int
+	Arrow   string
+	Delta   string
+	Rate    string
+	Age     string
+	IOB     string
+	COB     string
+	Range   string
+	Suspect string
+	Time    string
+}
+
+// withDefaults fills in the templates that aren't set from d.
+func (t textTemplates) withDefaults(d textTemplates) textTemplates {
+	if t.Title == "" {
+		t.Title = d.Title
+	}
+	if t.Previous == "" {
+		t.Previous = d.Previous
+	}
+	if t.LowAt == "" {
+		t.LowAt = d.LowAt
+	}
+	if t.InRangeAt == "" {
+		t.InRangeAt = d.InRangeAt
+	}
+	if t.Rate == "" {
+		t.Rate = d.Rate
+	}
+	return t
+}
+
+func (t textTemplates) parse() (p parsedTemplates, err error) {
+	if p.title, err = parseTemplate("title", t.Title); err != nil {
+		return
+	}
+	if p.previous, err = parseTemplate("previous", t.Previous); err != nil {
+		return
+	}
+	if p.lowAt, err = parseTemplate("lowAt", t.LowAt); err != nil {
+		return
+	}
+	if p.inRangeAt, err = parseTemplate("inRangeAt", t.InRangeAt); err != nil {
+		return
+	}
+	p.rate, err = parseTemplate("rate", t.Rate)
+	return
+}
+
+// parseTemplate parses the template and renders it once with empty data so
+// mistakes such as unknown fields are reported at startup.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s template: %s", name, err)
+	}
+	if err := t.Execute(ioutil.Discard, templateData{}); err != nil {
+		return nil, fmt.Errorf("Invalid %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+// delta is the change since the previous reading scaled to deltaMinutes, so
+// it reads the same whatever the source's cadence or if a reading was missed.
+func (b *bg) delta() (float64, bool) {
+	elapsed := b.Value.Timestamp - b.PreviousValue.Timestamp
+	if b.PreviousValue.Timestamp == 0 || elapsed <= 0 || elapsed > staleSeconds*1000 {
+		return 0, false
+	}
+	minutes := float64(elapsed) / float64(time.Minute/time.Millisecond)
+	return (b.Value.Value - b.PreviousValue.Value) / minutes * deltaMinutes, true
+}
+
+// rate is the rate of change in mg/dL per minute.
+func (b *bg) rate() (float64, bool) {
+	delta, ok := b.delta()
+	return delta * mgdltommol / deltaMinutes, ok
+}
+
+// templateData describes the current reading.
+func (p *profile) templateData() templateData {
+	d := p.readingData(p.bg.Value, p.bg.Direction.Value)
+	d.Range = p.rangeState()
+	if p.suspect != "" {
+		d.Suspect = p.suspectText()
+	}
+	if delta, ok := p.bg.delta(); ok {
+		d.Delta = fmt.Sprintf("%+.1f", delta)
+	}
+	if rate, ok := p.bg.rate(); ok {
+		d.Rate = fmt.Sprintf("%+.1f", rate)
+	}
+	if p.onBoard.IOB != nil {
+		d.IOB = fmt.Sprintf("%.2fU", *p.onBoard.IOB)
+	}
+	if p.onBoard.COB != nil {
+		d.COB = fmt.Sprintf("%.0fg", *p.onBoard.COB)
+	}
+	return d
+}
+
+func (p *profile) readingData(v bgValue, arrow string) templateData {
+	return templateData{
+		Name:  p.Name,
+		Value: fmt.Sprintf("%.1f", v.Value),
+		Mgdl:  int(math.Round(v.Value * mgdltommol)),
+		Arrow: arrow,
+		Age:   formatAge(p.now().Sub(time.Unix(0, v.Timestamp*int64(time.Millisecond)))),
+	}
+}
+
+// execute renders one of the profile's templates, logging any error since
+// templates are checked at startup.
+func (p *profile) execute(t *template.Template, d templateData) string {
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		logError("Failed to execute template", "profile", p.logName(), "err", err)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// format renders the reading with the title template.
+func (p *profile) format() string {
+	if p.templates.title == nil {
+		return p.bg.format()
+	}
+	return p.execute(p.templates.title, p.templateData())
+}
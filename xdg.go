@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// xdgDir returns the cgm directory under the XDG base directory named by env,
+// falling back to fallback under the home directory, and creates it.
+func xdgDir(env string, fallback string, elem ...string) (string, error) {
+	base := os.Getenv(env)
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, fallback)
+	}
+	dir := filepath.Join(append([]string{base, "cgm"}, elem...)...)
+	return dir, os.MkdirAll(dir, 0700)
+}